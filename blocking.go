@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Clients blocked in BLPOP, BRPOP and BRPOPLPUSH, by db and list, the longest
+// waiting is woken first. A client blocked on several lists waits in each of
+// them. Fairness is best effort: a client which has not blocked yet may pop
+// the element before the woken one does.
+type blockedClients struct {
+	sync.Mutex
+	waiters map[Store]map[string][]*waiter
+}
+
+type waiter struct {
+	wake chan struct{} // a push to one of the lists, buffered so pushes never block
+}
+
+func newBlockedClients() *blockedClients {
+	return &blockedClients{waiters: make(map[Store]map[string][]*waiter)}
+}
+
+func (b *blockedClients) add(db Store, keys [][]byte) *waiter {
+	w := &waiter{wake: make(chan struct{}, 1)}
+	b.Lock()
+	defer b.Unlock()
+	if b.waiters[db] == nil {
+		b.waiters[db] = make(map[string][]*waiter)
+	}
+	for _, key := range keys {
+		b.waiters[db][string(key)] = append(b.waiters[db][string(key)], w)
+	}
+	return w
+}
+
+func (b *blockedClients) remove(db Store, keys [][]byte, w *waiter) {
+	b.Lock()
+	defer b.Unlock()
+	for _, key := range keys {
+		ws := b.waiters[db][string(key)]
+		for i := range ws {
+			if ws[i] == w {
+				ws = append(ws[:i], ws[i+1:]...)
+				break
+			}
+		}
+		if len(ws) == 0 {
+			delete(b.waiters[db], string(key))
+		} else {
+			b.waiters[db][string(key)] = ws
+		}
+	}
+}
+
+// n elements are pushed to key, wake the n clients waiting the longest. The
+// ones that find nothing left keep their place.
+func (b *blockedClients) signal(db Store, key []byte, n int) {
+	b.Lock()
+	defer b.Unlock()
+	for i, w := range b.waiters[db][string(key)] {
+		if i >= n {
+			break
+		}
+		select {
+		case w.wake <- struct{}{}:
+		default: // woken already
+		}
+	}
+}
+
+// let clients blocked on key know about the n elements just pushed
+func (h *DbHandler) notifyPush(c *redisClient, key []byte, n int) {
+	if h.server != nil {
+		h.server.blocked.signal(baseStore(c.db), key, n)
+	}
+}
+
+// seconds, 0 for forever. Longer than a Duration holds, about 292 years, is
+// the longest one.
+func parseTimeout(b []byte) (time.Duration, error) {
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, ErrTimeoutNotFloat
+	} else if f < 0 {
+		return 0, ErrTimeoutNegative
+	}
+	if ns := f * float64(time.Second); ns >= math.MaxInt64 {
+		return math.MaxInt64, nil
+	} else if ns > 0 && ns < 1 {
+		return 1, nil // not forever
+	} else {
+		return time.Duration(ns), nil
+	}
+}
+
+// While c is blocked nobody reads from its connection. gone is closed if the
+// client goes away, call stop before reading again; anything the client sends
+// meanwhile is kept for the next ReadRequest.
+func (c *redisClient) watchConn() (gone chan struct{}, stop func()) {
+	gone, done := make(chan struct{}), make(chan struct{})
+	c.rbuf.moreSpace(c.rbuf.limit - c.rbuf.pos + 128)
+	go func() {
+		defer close(done)
+		if err := c.readMore(); err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				close(gone)
+			}
+		}
+	}()
+	return gone, func() {
+		c.conn.SetReadDeadline(time.Now())
+		<-done
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// Pop from the first of keys that is not empty, or wait for a push to any of
+// them. pop tells an empty element from an empty list by ok. Nil key if
+// timeout is up first, or the client goes away. In EXEC, it never waits.
+func (h *DbHandler) blockingPop(c *redisClient, keys [][]byte, timeout []byte,
+	pop func(key []byte) (value []byte, ok bool, err error)) (key, value []byte, err error) {
+	d, err := parseTimeout(timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	var w *waiter
+	var expired <-chan time.Time
+	var gone chan struct{}
+	db := baseStore(c.db)
+	for {
+		for _, key := range keys {
+			if value, ok, err := pop(key); err != nil || ok {
+				return key, value, err
+			}
+		}
+		if c.writes != nil || h.server == nil {
+			return nil, nil, nil
+		}
+
+		if w == nil { // try again once waiting, or a push right before is missed
+			w = h.server.blocked.add(db, keys)
+			defer h.leave(c, db, keys, w)
+			if d > 0 {
+				timer := time.NewTimer(d)
+				defer timer.Stop()
+				expired = timer.C
+			}
+			var stop func()
+			gone, stop = c.watchConn()
+			defer stop()
+			continue
+		}
+
+		select {
+		case <-w.wake:
+		case <-expired:
+			return nil, nil, nil
+		case <-gone:
+			return nil, nil, nil
+		}
+	}
+}
+
+// w stops waiting. A push meant to wake it is passed on to the next client
+func (h *DbHandler) leave(c *redisClient, db Store, keys [][]byte, w *waiter) {
+	h.server.blocked.remove(db, keys, w)
+	for _, key := range keys {
+		if n, err := h.Llen(c, key); err == nil && n > 0 {
+			h.server.blocked.signal(db, key, 1)
+		}
+	}
+}
+
+func (h *DbHandler) blockingListPop(c *redisClient, args [][]byte, left bool) (Reply, error) {
+	if len(args) < 2 {
+		return nil, ErrNotEnoughArgs
+	}
+	key, value, err := h.blockingPop(c, args[:len(args)-1], args[len(args)-1], func(key []byte) ([]byte, bool, error) {
+		return h.pop(c, key, left)
+	})
+	if err != nil || key == nil {
+		return ArrayReply{}, err // null array on timeout
+	}
+	return MultiBulkReply{[][]byte{key, value}}, nil
+}
+
+// BLPOP key [key ...] timeout
+func (h *DbHandler) Blpop(c *redisClient, args ...[]byte) (Reply, error) {
+	return h.blockingListPop(c, args, true)
+}
+
+// BRPOP key [key ...] timeout
+func (h *DbHandler) Brpop(c *redisClient, args ...[]byte) (Reply, error) {
+	return h.blockingListPop(c, args, false)
+}
+
+func (h *DbHandler) Brpoplpush(c *redisClient, src, dst, timeout []byte) (Reply, error) {
+	key, value, err := h.blockingPop(c, [][]byte{src}, timeout, func(key []byte) ([]byte, bool, error) {
+		return h.popPush(c, src, dst, false, true)
+	})
+	if err != nil || key == nil {
+		return ArrayReply{}, err
+	}
+	return BulkReply{value}, nil
+}
+
+// Pop an element from src and push it to dst, from and to the left or the
+// right, in one batch. ok is false if src is empty
+func (h *DbHandler) popPush(c *redisClient, src, dst []byte, fromLeft, toLeft bool) (value []byte, ok bool, err error) {
+	defer locks.lock(c, src, dst)()
+	sKey, dKey := encodeMetaKey(c.arena, src), encodeMetaKey(c.arena, dst)
+	old, err := getMeta(c, sKey, kTypeList)
+	if err != nil || old == nil {
+		return nil, false, err
+	}
+	same := bytes.Equal(src, dst)
+	var dOld []byte
+	if !same {
+		if dOld, err = getMeta(c, dKey, kTypeList); err != nil {
+			return nil, false, err // WRONGTYPE, before anything is popped
+		}
+	}
+
+	llen, _ := LinkedList(old).listMeta()
+	value, ks, vs, err := h.popRecords(c, sKey, LinkedList(old), fromLeft)
+	if err != nil {
+		return nil, false, err
+	} else if same && llen == 1 {
+		return value, true, nil // back to where it was
+	}
+
+	if same {
+		dOld = vs[0] // the meta after the pop
+	}
+	pks, pvs := h.pushRecords(c, dKey, LinkedList(dOld), [][]byte{value}, toLeft)
+	// ks and vs share their backing array, append to copies
+	ks, vs = append(append([][]byte{}, ks...), pks...), append(append([][]byte{}, vs...), pvs...)
+	if err := c.db.Batch(ks, vs); err != nil {
+		return nil, false, err
+	}
+	h.notifyPush(c, dst, 1)
+	return value, true, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlockingPop(t *testing.T) {
+	s, done := newTestServer(t, 1)
+	defer done()
+
+	// clients that block need a conn that can tell they are gone
+	newClient := func() (*redisClient, net.Conn) {
+		server, client := net.Pipe()
+		c := NewReisClient(server)
+		c.db = s.db(0)
+		return c, client
+	}
+	run := func(c *redisClient, args ...string) Reply {
+		r, err := s.Handle(c, newRequest(args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	async := func(c *redisClient, args ...string) chan Reply {
+		ch := make(chan Reply, 1)
+		go func() { ch <- run(c, args...) }()
+		return ch
+	}
+	// wait until n clients are blocked on key
+	blocked := func(key string, n int) {
+		for i := 0; i < 100; i++ {
+			s.blocked.Lock()
+			waiting := len(s.blocked.waiters[s.db(0)][key])
+			s.blocked.Unlock()
+			if waiting == n {
+				return
+			}
+			time.Sleep(time.Millisecond * 2)
+		}
+		t.Fatalf("expect %d clients blocked on %s", n, key)
+	}
+	pair := func(r Reply) string {
+		if vs := r.(MultiBulkReply).values; len(vs) == 2 {
+			return string(vs[0]) + "=" + string(vs[1])
+		}
+		return ""
+	}
+
+	c, _ := newClient()
+	run(c, "RPUSH", "b", "1")
+	if r := run(c, "BLPOP", "a", "b", "0"); pair(r) != "b=1" {
+		t.Errorf("expect b=1, get %v", r)
+	}
+	start := time.Now()
+	if r := run(c, "BRPOP", "a", "0.05"); r.(ArrayReply).replies != nil {
+		t.Errorf("expect timeout, get %v", r)
+	} else if d := time.Since(start); d < time.Millisecond*50 {
+		t.Errorf("expect waiting 50ms, get %v", d)
+	}
+
+	// the longest waiting client is served first
+	c1, _ := newClient()
+	c2, _ := newClient()
+	r1 := async(c1, "BLPOP", "q", "0")
+	blocked("q", 1)
+	r2 := async(c2, "BLPOP", "q", "other", "0")
+	blocked("q", 2)
+	run(c, "RPUSH", "q", "x")
+	if r := <-r1; pair(r) != "q=x" {
+		t.Errorf("expect q=x, get %v", r)
+	}
+	run(c, "LPUSH", "other", "y")
+	if r := <-r2; pair(r) != "other=y" {
+		t.Errorf("expect other=y, get %v", r)
+	}
+
+	// an empty element is popped, not waited past
+	run(c, "RPUSH", "e", "", strings.Repeat("v", kMaxCompactValue+1))
+	if r, ok := run(c, "BLPOP", "e", "0.05").(MultiBulkReply); !ok || pair(r) != "e=" {
+		t.Errorf("expect e=, get %v", r)
+	}
+
+	// pushed elements are moved
+	r1 = async(c1, "BRPOPLPUSH", "src", "dst", "1")
+	blocked("src", 1)
+	run(c, "RPUSH", "src", "v")
+	if r := <-r1; string(r.(BulkReply).value) != "v" {
+		t.Errorf("expect v, get %v", r)
+	}
+	if r := run(c, "LRANGE", "dst", "0", "-1"); len(r.(MultiBulkReply).values) != 1 {
+		t.Errorf("expect v in dst, get %v", r)
+	}
+
+	// a client gone does not take the next element
+	c3, conn := newClient()
+	r3 := async(c3, "BLPOP", "gone", "0")
+	blocked("gone", 1)
+	conn.Close()
+	if r := <-r3; r.(ArrayReply).replies != nil {
+		t.Errorf("expect nothing, get %v", r)
+	}
+	blocked("gone", 0)
+	run(c, "RPUSH", "gone", "z")
+	if n, _ := (&DbHandler{}).Llen(c, []byte("gone")); n != 1 {
+		t.Errorf("expect the element kept, get %v", n)
+	}
+
+	// MULTI never blocks
+	run(c, "MULTI")
+	run(c, "BLPOP", "empty", "0")
+	if r := run(c, "EXEC"); r.(ArrayReply).replies[0].(ArrayReply).replies != nil {
+		t.Errorf("expect a null reply, get %v", r)
+	}
+	if r := run(c, "BLPOP", "q", "-1"); r != ErrTimeoutNegative {
+		t.Errorf("expect negative timeout error, get %v", r)
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	for s, d := range map[string]time.Duration{"0": 0, "1.5": time.Second * 3 / 2, "1e-12": 1,
+		"1e9": 1e9 * time.Second, "1e12": math.MaxInt64} {
+		if v, err := parseTimeout([]byte(s)); v != d || err != nil {
+			t.Errorf("%s: expect %v, get %v, %v", s, d, v, err)
+		}
+	}
+	if _, err := parseTimeout([]byte("-1")); err != ErrTimeoutNegative {
+		t.Errorf("expect negative timeout, get %v", err)
+	}
+}
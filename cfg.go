@@ -89,7 +89,11 @@ func ReadCfg(dst interface{}, path string) error {
 	pValue := reflect.ValueOf(dst).Elem()
 	for i := 0; i < pValue.NumField(); i++ {
 		f := pValue.Field(i)
-		name := reflect.TypeOf(dst).Elem().Field(i).Name
+		field := reflect.TypeOf(dst).Elem().Field(i)
+		if field.Tag.Get("cfg") == "optional" { // left out for the default
+			continue
+		}
+		name := field.Name
 		switch f.Type().Kind() {
 		case reflect.Int:
 			if f.Int() == 0 {
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -39,3 +41,18 @@ func TestMemtoll(t *testing.T) {
 		t.Errorf("failt to convert 10, get %v", v)
 	}
 }
+
+func TestReadCfgOptional(t *testing.T) {
+	f, err := ioutil.TempFile("", "rockredis.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("addr :6379\ndir /tmp\nhttp :6667\ncompression snappy\nloglevel info\nlogfile log\ndatabases 16\ncache 1m\n")
+	f.Close()
+
+	cfg := &RockRedisConf{}
+	if err := ReadCfg(cfg, f.Name()); err != nil {
+		t.Errorf("expect the ziplist configs optional, get %v", err)
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// a bit offset into a string of up to maxStringSize
+func parseBitOffset(b []byte) (int, error) {
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || n < 0 || n >= maxStringSize*8 {
+		return 0, ErrBitOffset
+	}
+	return int(n), nil
+}
+
+func parseBit(b []byte) (int, error) {
+	if len(b) != 1 || (b[0] != '0' && b[0] != '1') {
+		return 0, ErrBitValue
+	}
+	return int(b[0] - '0'), nil
+}
+
+// SETBIT key offset value, the old bit
+func (h *DbHandler) Setbit(c *redisClient, key, offset, value []byte) (int, error) {
+	off, err := parseBitOffset(offset)
+	if err != nil {
+		return 0, err
+	}
+	bit, err := parseBit(value)
+	if err != nil {
+		return 0, err
+	}
+	defer locks.lock(c, key)()
+	b, err := loadBitmap(c, key)
+	if err != nil {
+		return 0, err
+	}
+	old, err := b.getBit(off)
+	if err != nil {
+		return 0, err
+	} else if err := b.setBit(off, bit); err != nil {
+		return 0, err
+	}
+	return old, b.save()
+}
+
+func (h *DbHandler) Getbit(c *redisClient, key, offset []byte) (int, error) {
+	off, err := parseBitOffset(offset)
+	if err != nil {
+		return 0, err
+	}
+	b, err := loadBitmap(c, key)
+	if err != nil {
+		return 0, err
+	}
+	return b.getBit(off)
+}
+
+// [start end [BYTE|BIT]] of BITCOUNT and BITPOS to the first and last bit,
+// negative counts from the end. ok is false if the range is empty
+func bitRange(size int, args [][]byte) (first, last int, ok bool, err error) {
+	start, end, unit := 0, -1, 8
+	if len(args) > 3 {
+		return 0, 0, false, ErrSyntax
+	}
+	if len(args) > 0 {
+		if start, err = strconv.Atoi(string(args[0])); err != nil {
+			return 0, 0, false, ErrExpectInteger
+		}
+	}
+	if len(args) > 1 {
+		if end, err = strconv.Atoi(string(args[1])); err != nil {
+			return 0, 0, false, ErrExpectInteger
+		}
+	}
+	if len(args) > 2 {
+		switch strings.ToUpper(string(args[2])) {
+		case "BYTE":
+		case "BIT":
+			unit = 1
+		default:
+			return 0, 0, false, ErrSyntax
+		}
+	}
+
+	total := size * 8 / unit
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= total {
+		end = total - 1
+	}
+	if start > end {
+		return 0, 0, false, nil
+	}
+	return start * unit, end*unit + unit - 1, true, nil
+}
+
+// call fn with the bytes holding bits first to last, and the bit offset of
+// each, bits out of the range are zeros. flip inverts the bits first
+func (b *bitmap) scanBytes(first, last int, flip bool, fn func(offset int, v byte) bool) error {
+	lo, hi := first/8, last/8
+	return b.scanPages(lo/kBitmapPageSize, hi/kBitmapPageSize, func(i int, p []byte) bool {
+		from, to := i*kBitmapPageSize, (i+1)*kBitmapPageSize-1
+		if from < lo {
+			from = lo
+		}
+		if to > hi {
+			to = hi
+		}
+		for j := from; j <= to; j++ {
+			var v byte
+			if k := j - i*kBitmapPageSize; k < len(p) {
+				v = p[k]
+			}
+			if flip {
+				v = ^v
+			}
+			if j == lo {
+				v &= 0xff >> uint(first%8)
+			}
+			if j == hi {
+				v &= 0xff << uint(7-last%8)
+			}
+			if !fn(j*8, v) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// BITCOUNT key [start end [BYTE|BIT]]
+func (h *DbHandler) Bitcount(c *redisClient, key []byte, args ...[]byte) (int, error) {
+	if len(args) == 1 {
+		return 0, ErrSyntax
+	}
+	b, err := loadBitmap(c, key)
+	if err != nil {
+		return 0, err
+	}
+	first, last, ok, err := bitRange(b.size, args)
+	if err != nil || !ok {
+		return 0, err
+	}
+	n := 0
+	err = b.scanBytes(first, last, false, func(offset int, v byte) bool {
+		n += bits.OnesCount8(v)
+		return true
+	})
+	return n, err
+}
+
+// BITPOS key bit [start [end [BYTE|BIT]]]. Without an end, the string is
+// taken as padded with zeros: a clear bit is found right after it
+func (h *DbHandler) Bitpos(c *redisClient, key, bit []byte, args ...[]byte) (int, error) {
+	want, err := parseBit(bit)
+	if err != nil {
+		return 0, err
+	}
+	b, err := loadBitmap(c, key)
+	if err != nil {
+		return 0, err
+	}
+	first, last, ok, err := bitRange(b.size, args)
+	if err != nil {
+		return 0, err
+	} else if b.meta == nil {
+		return -want, nil // a missing key is all zeros: -1 for a set bit, 0 for a clear one
+	} else if !ok {
+		return -1, nil
+	}
+	pos := -1
+	err = b.scanBytes(first, last, want == 0, func(offset int, v byte) bool {
+		if v != 0 {
+			pos = offset + bits.LeadingZeros8(v)
+		}
+		return pos == -1
+	})
+	if pos == -1 && want == 0 && len(args) < 2 {
+		pos = last + 1
+	}
+	return pos, err
+}
+
+// BITOP AND|OR|XOR|NOT destkey key [key ...], the size of destkey. Missing
+// keys are zeros, a result of no bytes deletes destkey
+func (h *DbHandler) Bitop(c *redisClient, op, dst []byte, keys ...[]byte) (int, error) {
+	name := strings.ToUpper(string(op))
+	switch {
+	case len(keys) == 0:
+		return 0, ErrWrongArgsNumber
+	case name == "NOT" && len(keys) != 1:
+		return 0, ErrBitopNot
+	case name != "AND" && name != "OR" && name != "XOR" && name != "NOT":
+		return 0, ErrSyntax
+	}
+	defer locks.lock(c, append([][]byte{dst}, keys...)...)()
+	srcs, size := make([]*bitmap, len(keys)), 0
+	for i, key := range keys {
+		b, err := loadBitmap(c, key)
+		if err != nil {
+			return 0, err
+		}
+		if srcs[i] = b; b.size > size {
+			size = b.size
+		}
+	}
+
+	// dst is replaced, whatever it is
+	dKey := encodeMetaKey(c.arena, dst)
+	var ks, vs [][]byte
+	if old, err := getMeta(c, dKey, 0); err != nil {
+		return 0, err
+	} else if old != nil {
+		if ks, _, err = keyRecords(c, dKey, old, false); err != nil {
+			return 0, err
+		}
+		vs = make([][]byte, len(ks))
+	}
+	result := newBitmap(c, dKey)
+	result.size = size
+	pages := make([][]byte, len(srcs))
+	for i := 0; i*kBitmapPageSize < size; i++ {
+		for j, src := range srcs {
+			var err error
+			if pages[j], err = src.readPage(i); err != nil {
+				return 0, err
+			}
+		}
+		out, zeros := make([]byte, kBitmapPageSize), true
+		for k := range out {
+			var v byte
+			for j, p := range pages {
+				var x byte
+				if k < len(p) {
+					x = p[k]
+				}
+				switch {
+				case j == 0:
+					v = x
+				case name == "AND":
+					v &= x
+				case name == "OR":
+					v |= x
+				case name == "XOR":
+					v ^= x
+				}
+			}
+			if name == "NOT" {
+				v = ^v
+			}
+			out[k], zeros = v, zeros && v == 0
+		}
+		if !zeros { // missing pages are zeros
+			result.pages[i] = out
+		}
+	}
+
+	if size > 0 {
+		rks, rvs, err := result.records()
+		if err != nil {
+			return 0, err
+		}
+		ks, vs = append(ks, rks...), append(vs, rvs...) // after the deletes, so they win
+	}
+	if len(ks) == 0 {
+		return 0, nil
+	}
+	return size, c.db.Batch(ks, vs)
+}
+
+// an operation of BITFIELD
+type bitfieldOp struct {
+	cmd      string // GET, SET or INCRBY
+	signed   bool
+	bits     int
+	offset   int
+	value    int64 // of SET, or the increment of INCRBY
+	overflow string
+}
+
+// i1 to i64, u1 to u63
+func parseBitfieldType(b []byte) (signed bool, n int, err error) {
+	if len(b) < 2 {
+		return false, 0, ErrBitfieldType
+	}
+	signed = b[0] == 'i' || b[0] == 'I'
+	n, err = strconv.Atoi(string(b[1:]))
+	if err != nil || (!signed && b[0] != 'u' && b[0] != 'U') || n < 1 || (signed && n > 64) || (!signed && n > 63) {
+		return false, 0, ErrBitfieldType
+	}
+	return signed, n, nil
+}
+
+// a bit offset, or #N for the Nth field of n bits
+func parseBitfieldOffset(b []byte, n int) (int, error) {
+	mul := 1
+	if len(b) > 0 && b[0] == '#' {
+		b, mul = b[1:], n
+	}
+	off, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || off < 0 || off > (maxStringSize*8-int64(n))/int64(mul) {
+		return 0, ErrBitOffset
+	}
+	return int(off) * mul, nil
+}
+
+func parseBitfield(args [][]byte) ([]bitfieldOp, error) {
+	ops, overflow := make([]bitfieldOp, 0, len(args)/3), "WRAP"
+	for i := 0; i < len(args); {
+		op := bitfieldOp{cmd: strings.ToUpper(string(args[i])), overflow: overflow}
+		need := 3
+		switch op.cmd {
+		case "OVERFLOW":
+			need = 2
+		case "GET":
+		case "SET", "INCRBY":
+			need = 4
+		default:
+			return nil, ErrSyntax
+		}
+		if i+need > len(args) {
+			return nil, ErrSyntax
+		}
+		if op.cmd == "OVERFLOW" {
+			switch overflow = strings.ToUpper(string(args[i+1])); overflow {
+			case "WRAP", "SAT", "FAIL":
+			default:
+				return nil, ErrBitfieldOverflow
+			}
+			i += need
+			continue
+		}
+
+		var err error
+		if op.signed, op.bits, err = parseBitfieldType(args[i+1]); err != nil {
+			return nil, err
+		}
+		if op.offset, err = parseBitfieldOffset(args[i+2], op.bits); err != nil {
+			return nil, err
+		}
+		if need == 4 {
+			if op.value, err = strconv.ParseInt(string(args[i+3]), 10, 64); err != nil {
+				return nil, ErrExpectInteger
+			}
+		}
+		ops, i = append(ops, op), i+need
+	}
+	return ops, nil
+}
+
+// value + incr in n bits unsigned, wrapped or saturated by mode if it overflows, like redis
+func bitfieldUnsigned(value uint64, incr int64, n int, mode string) (uint64, bool) {
+	max := uint64(1)<<uint(n) - 1
+	maxincr, minincr := int64(max-value), -int64(value)
+	if value > max || (incr > 0 && incr > maxincr) {
+		if mode == "WRAP" {
+			return (value + uint64(incr)) & max, true
+		}
+		return max, true
+	} else if incr < 0 && incr < minincr {
+		if mode == "WRAP" {
+			return (value + uint64(incr)) & max, true
+		}
+		return 0, true
+	}
+	return value + uint64(incr), false
+}
+
+// value + incr in n bits signed, wrapped or saturated by mode if it overflows, like redis
+func bitfieldSigned(value, incr int64, n int, mode string) (int64, bool) {
+	max := int64(math.MaxInt64)
+	if n < 64 {
+		max = 1<<uint(n-1) - 1
+	}
+	min := -max - 1
+	maxincr, minincr := int64(uint64(max)-uint64(value)), min-value // used only when they do not overflow
+
+	limit, overflow := int64(0), false
+	if value > max || (n != 64 && incr > maxincr) || (value >= 0 && incr > 0 && incr > maxincr) {
+		limit, overflow = max, true
+	} else if value < min || (n != 64 && incr < minincr) || (value < 0 && incr < 0 && incr < minincr) {
+		limit, overflow = min, true
+	}
+	if !overflow {
+		return value + incr, false
+	} else if mode != "WRAP" {
+		return limit, true
+	}
+	v := uint64(value) + uint64(incr)
+	if n < 64 { // keep the sign bit of n bits
+		if mask := ^uint64(0) << uint(n); v&(1<<uint(n-1)) != 0 {
+			v |= mask
+		} else {
+			v &^= mask
+		}
+	}
+	return int64(v), true
+}
+
+func (b *bitmap) getBits(offset, n int) (uint64, error) {
+	var v uint64
+	for i := 0; i < n; i++ {
+		bit, err := b.getBit(offset + i)
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | uint64(bit)
+	}
+	return v, nil
+}
+
+func (b *bitmap) setBits(offset, n int, v uint64) error {
+	for i := 0; i < n; i++ {
+		if err := b.setBit(offset+i, int(v>>uint(n-1-i))&1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BITFIELD key [GET type offset] [SET type offset value] [INCRBY type offset increment]
+// [OVERFLOW WRAP|SAT|FAIL]. A nil reply for an operation FAIL stops
+func (h *DbHandler) Bitfield(c *redisClient, key []byte, args ...[]byte) (Reply, error) {
+	ops, err := parseBitfield(args)
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range ops {
+		if op.cmd != "GET" {
+			defer locks.lock(c, key)()
+			break
+		}
+	}
+	b, err := loadBitmap(c, key)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, written := make([]Reply, 0, len(ops)), false
+	for _, op := range ops {
+		raw, err := b.getBits(op.offset, op.bits)
+		if err != nil {
+			return nil, err
+		}
+		old := int64(raw)
+		if op.signed && op.bits < 64 && raw>>uint(op.bits-1) != 0 {
+			old = int64(raw | ^uint64(0)<<uint(op.bits)) // negative
+		}
+		if op.cmd == "GET" {
+			replies = append(replies, IntReply{int(old)})
+			continue
+		}
+
+		var v int64
+		var overflow bool
+		switch {
+		case op.signed && op.cmd == "SET":
+			v, overflow = bitfieldSigned(op.value, 0, op.bits, op.overflow)
+		case op.signed:
+			v, overflow = bitfieldSigned(old, op.value, op.bits, op.overflow)
+		case op.cmd == "SET":
+			u, o := bitfieldUnsigned(uint64(op.value), 0, op.bits, op.overflow)
+			v, overflow = int64(u), o
+		default:
+			u, o := bitfieldUnsigned(raw, op.value, op.bits, op.overflow)
+			v, overflow = int64(u), o
+		}
+		if overflow && op.overflow == "FAIL" {
+			replies = append(replies, BulkReply{nil})
+			continue
+		}
+		if err := b.setBits(op.offset, op.bits, uint64(v)); err != nil {
+			return nil, err
+		}
+		written = true
+		if op.cmd == "SET" {
+			replies = append(replies, IntReply{int(old)})
+		} else {
+			replies = append(replies, IntReply{int(v)})
+		}
+	}
+	if written {
+		if err := b.save(); err != nil {
+			return nil, err
+		}
+	}
+	return ArrayReply{replies}, nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// page keys of every bitmap in db
+func pageKeys(c *redisClient) int {
+	ks, _, _ := scanRecords(c, []byte{kBitmapPageKeyPrefix}, false, nil, nil)
+	return len(ks)
+}
+
+func TestBitCommands(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+	args := func(s string) [][]byte {
+		return bytes.Fields([]byte(s))
+	}
+
+	h.Set(c, []byte("s"), []byte("foobar"))
+	if n, _ := h.Bitcount(c, []byte("s")); n != 26 {
+		t.Errorf("expect 26, get %v", n)
+	}
+	if n, _ := h.Bitcount(c, []byte("s"), args("1 1")...); n != 6 {
+		t.Errorf("expect 6, get %v", n)
+	}
+	if n, _ := h.Bitcount(c, []byte("s"), args("5 30 BIT")...); n != 17 {
+		t.Errorf("expect 17, get %v", n)
+	}
+	if _, err := h.Bitcount(c, []byte("s"), []byte("1")); err != ErrSyntax {
+		t.Errorf("expect syntax error, get %v", err)
+	}
+
+	if n, _ := h.Setbit(c, []byte("b"), []byte("7"), []byte("1")); n != 0 {
+		t.Errorf("expect 0, get %v", n)
+	}
+	if n, _ := h.Setbit(c, []byte("b"), []byte("7"), []byte("0")); n != 1 {
+		t.Errorf("expect 1, get %v", n)
+	}
+	if _, err := h.Setbit(c, []byte("b"), []byte("-1"), []byte("1")); err != ErrBitOffset {
+		t.Errorf("expect offset error, get %v", err)
+	}
+	if _, err := h.Setbit(c, []byte("b"), []byte("1"), []byte("2")); err != ErrBitValue {
+		t.Errorf("expect bit error, get %v", err)
+	}
+	if v, _ := h.Get(c, []byte("b")); !bytes.Equal(v, []byte{0}) {
+		t.Errorf("expect a zero byte, get %q", v)
+	}
+
+	h.Set(c, []byte("p"), []byte{0xff, 0xf0, 0x00})
+	for _, tc := range []struct {
+		args string
+		pos  int
+	}{{"0", 12}, {"1 2", -1}, {"0 2 -1 BYTE", 16}, {"1 7 15 BIT", 7}, {"0 0 0", -1}} {
+		a := args(tc.args)
+		if n, _ := h.Bitpos(c, []byte("p"), a[0], a[1:]...); n != tc.pos {
+			t.Errorf("bitpos %s: expect %d, get %d", tc.args, tc.pos, n)
+		}
+	}
+	h.Set(c, []byte("p"), []byte{0xff})
+	if n, _ := h.Bitpos(c, []byte("p"), []byte("0")); n != 8 {
+		t.Errorf("expect 8 past the end, get %v", n)
+	}
+	if n, _ := h.Bitpos(c, []byte("missing"), []byte("0")); n != 0 {
+		t.Errorf("expect 0, get %v", n)
+	}
+
+	// past a page, the bitmap is saved in pages, the zero ones are not
+	if n, _ := h.Setbit(c, []byte("big"), []byte("10000"), []byte("1")); n != 0 || pageKeys(c) != 0 {
+		t.Errorf("expect a string, get %v, %d pages", n, pageKeys(c))
+	}
+	h.Expire(c, []byte("big"), 100)
+	h.Setbit(c, []byte("big"), []byte("1"), []byte("1"))
+	h.Setbit(c, []byte("big"), []byte("1000000"), []byte("1"))
+	if n := pageKeys(c); n != 2 {
+		t.Errorf("expect 2 pages, get %d", n)
+	}
+	if n, _ := h.Strlen(c, []byte("big")); n != 1000000/8+1 {
+		t.Errorf("expect %d, get %v", 1000000/8+1, n)
+	}
+	if v, _ := h.Get(c, []byte("big")); len(v) != 1000000/8+1 || v[0] != 0x40 || v[len(v)-1] != 0x80 {
+		t.Errorf("expect the bits back, get %d bytes", len(v))
+	}
+	if n, _ := h.Bitcount(c, []byte("big")); n != 3 {
+		t.Errorf("expect 3, get %v", n)
+	}
+	if n, _ := h.Bitpos(c, []byte("big"), []byte("1"), []byte("2")); n != 10000 {
+		t.Errorf("expect 10000, get %v", n)
+	}
+	if n, _ := h.Getbit(c, []byte("big"), []byte("10000")); n != 1 {
+		t.Errorf("expect 1, get %v", n)
+	}
+	if ttl, _ := h.Ttl(c, []byte("big")); ttl <= 0 {
+		t.Errorf("expect the ttl kept, get %v", ttl)
+	}
+	h.Setbit(c, []byte("big"), []byte("1000000"), []byte("0"))
+	if n := pageKeys(c); n != 1 {
+		t.Errorf("expect 1 page, get %d", n)
+	}
+	if _, err := h.Incr(c, []byte("big")); err != ErrExpectInteger {
+		t.Errorf("expect integer error, get %v", err)
+	}
+	h.Set(c, []byte("big"), []byte("x"))
+	if n := pageKeys(c); n != 0 {
+		t.Errorf("expect pages gone, get %d", n)
+	}
+	h.Setbit(c, []byte("big"), []byte("50000"), []byte("1"))
+	h.Del(c, []byte("big"))
+	if n := pageKeys(c); n != 0 {
+		t.Errorf("expect pages gone, get %d", n)
+	}
+
+	h.Hset(c, []byte("h"), args("a 1")...)
+	if _, err := h.Setbit(c, []byte("h"), []byte("1"), []byte("1")); err != ErrWrongType {
+		t.Errorf("expect wrong type, get %v", err)
+	}
+}
+
+func TestBitop(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+
+	h.Set(c, []byte("a"), []byte("foobar"))
+	h.Set(c, []byte("b"), []byte("abcdef"))
+	for op, expect := range map[string]string{"AND": "`bc`ab", "OR": "goofev", "XOR": "\a\r\f\x06\x04\x14"} {
+		if n, _ := h.Bitop(c, []byte(op), []byte("d"), []byte("a"), []byte("b")); n != 6 {
+			t.Errorf("%s: expect 6, get %v", op, n)
+		}
+		if v, _ := h.Get(c, []byte("d")); string(v) != expect {
+			t.Errorf("%s: expect %q, get %q", op, expect, v)
+		}
+	}
+	h.Set(c, []byte("a"), []byte{0x0f})
+	if n, _ := h.Bitop(c, []byte("and"), []byte("d"), []byte("a"), []byte("missing")); n != 1 {
+		t.Errorf("expect 1, get %v", n)
+	}
+	if v, _ := h.Get(c, []byte("d")); !bytes.Equal(v, []byte{0}) {
+		t.Errorf("expect a zero byte, get %q", v)
+	}
+	if _, err := h.Bitop(c, []byte("NOT"), []byte("d"), []byte("a"), []byte("b")); err != ErrBitopNot {
+		t.Errorf("expect not error, get %v", err)
+	}
+	if n, _ := h.Bitop(c, []byte("NOT"), []byte("d"), []byte("missing")); n != 0 {
+		t.Errorf("expect 0, get %v", n)
+	}
+	if n, _ := h.Exists(c, []byte("d")); n != 0 {
+		t.Errorf("expect d deleted, get %v", n)
+	}
+
+	// into pages, and back to a string
+	h.Setbit(c, []byte("big"), []byte("80000"), []byte("1"))
+	if n, _ := h.Bitop(c, []byte("NOT"), []byte("d"), []byte("big")); n != 10001 || pageKeys(c) != 1+3 {
+		t.Errorf("expect 10001, get %v, %d pages", n, pageKeys(c))
+	}
+	if n, _ := h.Bitcount(c, []byte("d")); n != 80007 {
+		t.Errorf("expect 80007, get %v", n)
+	}
+	if n, _ := h.Bitop(c, []byte("OR"), []byte("d"), []byte("a")); n != 1 || pageKeys(c) != 1 {
+		t.Errorf("expect 1, get %v, %d pages", n, pageKeys(c))
+	}
+}
+
+func TestBitfield(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+	run := func(s string) []Reply {
+		r, err := h.Bitfield(c, []byte("f"), bytes.Fields([]byte(s))...)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		return r.(ArrayReply).replies
+	}
+	expect := func(s string, replies ...Reply) {
+		r := run(s)
+		if len(r) != len(replies) {
+			t.Fatalf("%s: expect %v, get %v", s, replies, r)
+		}
+		for i := range r {
+			if a, ok := r[i].(BulkReply); ok && a.value == nil {
+				if b, ok := replies[i].(BulkReply); !ok || b.value != nil {
+					t.Errorf("%s: expect %v, get %v", s, replies, r)
+				}
+			} else if r[i] != replies[i] {
+				t.Errorf("%s: expect %v, get %v", s, replies, r)
+			}
+		}
+	}
+	null := BulkReply{nil}
+
+	expect("SET i8 0 100 GET i8 0 GET u4 0", IntReply{0}, IntReply{100}, IntReply{6})
+	expect("INCRBY i8 0 100", IntReply{-56})
+	expect("OVERFLOW SAT INCRBY i8 0 -100 INCRBY i8 0 -100", IntReply{-128}, IntReply{-128})
+	expect("OVERFLOW FAIL INCRBY i8 0 -1 GET i8 0", null, IntReply{-128})
+	expect("SET u2 #1 5 GET u2 #1", IntReply{0}, IntReply{1})
+	expect("OVERFLOW SAT SET u2 #1 5 INCRBY u2 #1 -9", IntReply{1}, IntReply{0})
+	expect("OVERFLOW WRAP INCRBY u2 100 7 INCRBY u63 0 1", IntReply{3}, IntReply{0x4000000000000001})
+	expect("SET i64 0 -1 INCRBY i64 0 1 OVERFLOW FAIL INCRBY i64 0 -9223372036854775807 INCRBY i64 0 -9223372036854775807",
+		IntReply{-9223372036854775806}, IntReply{0}, IntReply{-9223372036854775807}, null)
+	if v, _ := h.Get(c, []byte("f")); len(v) != 13 {
+		t.Errorf("expect 13 bytes, get %q", v)
+	}
+
+	for s, err := range map[string]error{
+		"GET u64 0":         ErrBitfieldType,
+		"GET i0 0":          ErrBitfieldType,
+		"GET x8 0":          ErrBitfieldType,
+		"GET u8 -1":         ErrBitOffset,
+		"GET u8 4294967289": ErrBitOffset,
+		"SET u8 0 x":        ErrExpectInteger,
+		"OVERFLOW NONE":     ErrBitfieldOverflow,
+		"INCRBY u8 0":       ErrSyntax,
+		"DECRBY u8 0 1":     ErrSyntax,
+	} {
+		if _, e := h.Bitfield(c, []byte("f"), bytes.Fields([]byte(s))...); e != err {
+			t.Errorf("%s: expect %v, get %v", s, err, e)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GEOADD key [NX|XX] [CH] longitude latitude member [longitude latitude member ...]
+func (h *DbHandler) Geoadd(c *redisClient, key []byte, args ...[]byte) (int, error) {
+	flags := zaddFlags{}
+	for len(args) > 0 {
+		switch strings.ToUpper(string(args[0])) {
+		case "NX":
+			flags.nx = true
+		case "XX":
+			flags.xx = true
+		case "CH":
+			flags.ch = true
+		default:
+			goto triples
+		}
+		args = args[1:]
+	}
+triples:
+	if len(args) == 0 || len(args)%3 != 0 || (flags.nx && flags.xx) {
+		return 0, ErrSyntax
+	}
+
+	scores, members := make([]float64, len(args)/3), make([][]byte, len(args)/3)
+	for i := 0; i < len(args); i += 3 {
+		lon, lat, err := parseGeoPosition(args[i], args[i+1])
+		if err != nil {
+			return 0, err
+		}
+		scores[i/3], members[i/3] = float64(geohashEncode(lon, lat)), args[i+2]
+	}
+	added, changed, _, _, err := h.zadd(c, key, flags, scores, members)
+	if flags.ch {
+		return added + changed, err
+	}
+	return added, err
+}
+
+// GEOPOS key [member ...], a null array for a missing member
+func (h *DbHandler) Geopos(c *redisClient, key []byte, members ...[]byte) (Reply, error) {
+	defer h.compactView(c)()
+	metaKey := encodeMetaKey(c.arena, key)
+	old, err := getMeta(c, metaKey, kTypeZset)
+	if err != nil {
+		return nil, err
+	}
+	replies := make([]Reply, len(members))
+	for i, member := range members {
+		replies[i] = ArrayReply{}
+		if old == nil {
+			continue
+		}
+		if score, ok, err := zsetScore(c, metaKey, member); err != nil {
+			return nil, err
+		} else if ok {
+			lon, lat := geohashDecode(uint64(score))
+			replies[i] = MultiBulkReply{[][]byte{formatCoordinate(lon), formatCoordinate(lat)}}
+		}
+	}
+	return ArrayReply{replies}, nil
+}
+
+// GEODIST key member1 member2 [M|KM|FT|MI], nil if a member is missing
+func (h *DbHandler) Geodist(c *redisClient, key, member1, member2 []byte, args ...[]byte) ([]byte, error) {
+	unit := 1.0
+	if len(args) > 1 {
+		return nil, ErrSyntax
+	} else if len(args) == 1 {
+		var err error
+		if unit, err = parseGeoUnit(args[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	defer h.compactView(c)()
+	metaKey := encodeMetaKey(c.arena, key)
+	if old, err := getMeta(c, metaKey, kTypeZset); err != nil || old == nil {
+		return nil, err
+	}
+	var pos [4]float64
+	for i, member := range [][]byte{member1, member2} {
+		score, ok, err := zsetScore(c, metaKey, member)
+		if err != nil || !ok {
+			return nil, err
+		}
+		pos[i*2], pos[i*2+1] = geohashDecode(uint64(score))
+	}
+	return formatDistance(geoDistance(pos[0], pos[1], pos[2], pos[3]), unit), nil
+}
+
+// what GEORADIUS and GEOSEARCH look for, and how they reply
+type geoQuery struct {
+	shape                         geoShape
+	unit                          float64
+	member                        []byte // FROMMEMBER, the center
+	from, by                      int    // how many centers and shapes given
+	withDist, withHash, withCoord bool
+	sort                          int // 1 ASC, -1 DESC
+	count                         int
+	any                           bool
+	store                         []byte
+	storeDist                     bool
+}
+
+// a member found, with its distance from the center in meters
+type geoPoint struct {
+	member   []byte
+	hash     uint64
+	dist     float64
+	lon, lat float64
+}
+
+func parseGeoDistance(b []byte) (float64, error) {
+	v, err := parseScore(b)
+	if err == nil && v < 0 {
+		return 0, ErrGeoNegative
+	}
+	return v, err
+}
+
+// BYRADIUS radius unit, as GEORADIUS takes them too
+func (q *geoQuery) parseRadius(radius, unit []byte) (err error) {
+	if q.unit, err = parseGeoUnit(unit); err != nil {
+		return err
+	}
+	if q.shape.radius, err = parseGeoDistance(radius); err != nil {
+		return err
+	}
+	q.shape.radius *= q.unit
+	q.by++
+	return nil
+}
+
+// the options of GEORADIUS, or of GEOSEARCH if search
+func (q *geoQuery) parse(args [][]byte, search bool) error {
+	for i := 0; i < len(args); i++ {
+		more := len(args) - 1 - i
+		switch opt := strings.ToUpper(string(args[i])); {
+		case opt == "WITHDIST":
+			q.withDist = true
+		case opt == "WITHHASH":
+			q.withHash = true
+		case opt == "WITHCOORD":
+			q.withCoord = true
+		case opt == "ASC":
+			q.sort = 1
+		case opt == "DESC":
+			q.sort = -1
+		case opt == "COUNT" && more >= 1:
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return ErrExpectInteger
+			} else if n <= 0 {
+				return ErrCountNotPositive
+			}
+			q.count, i = n, i+1
+			if i+1 < len(args) && strings.ToUpper(string(args[i+1])) == "ANY" {
+				q.any, i = true, i+1
+			}
+		case opt == "ANY":
+			return ErrGeoAny
+		case opt == "STORE" && !search && more >= 1:
+			q.store, i = args[i+1], i+1
+		case opt == "STOREDIST" && !search && more >= 1:
+			q.store, q.storeDist, i = args[i+1], true, i+1
+		case opt == "STOREDIST" && search && q.store != nil: // of GEOSEARCHSTORE
+			q.storeDist = true
+		case opt == "FROMMEMBER" && search && more >= 1:
+			q.member, q.from, i = args[i+1], q.from+1, i+1
+		case opt == "FROMLONLAT" && search && more >= 2:
+			var err error
+			if q.shape.lon, q.shape.lat, err = parseGeoPosition(args[i+1], args[i+2]); err != nil {
+				return err
+			}
+			q.from, i = q.from+1, i+2
+		case opt == "BYRADIUS" && search && more >= 2:
+			if err := q.parseRadius(args[i+1], args[i+2]); err != nil {
+				return err
+			}
+			i += 2
+		case opt == "BYBOX" && search && more >= 3:
+			var err error
+			if q.unit, err = parseGeoUnit(args[i+3]); err != nil {
+				return err
+			}
+			if q.shape.width, err = parseGeoDistance(args[i+1]); err != nil {
+				return err
+			}
+			if q.shape.height, err = parseGeoDistance(args[i+2]); err != nil {
+				return err
+			}
+			q.shape.width, q.shape.height = q.shape.width*q.unit, q.shape.height*q.unit
+			q.by, i = q.by+1, i+3
+		default:
+			return ErrSyntax
+		}
+	}
+	if search && (q.from != 1 || q.by != 1) {
+		return ErrGeoShape
+	} else if q.store != nil && (q.withDist || q.withHash || q.withCoord) {
+		return ErrGeoStoreWith
+	}
+	return nil
+}
+
+// The members in the shape, found by scanning the score ranges of a few
+// cells around the center. Sorted by distance if asked, or to keep the
+// nearest COUNT
+func (h *DbHandler) geoSearch(c *redisClient, key []byte, q *geoQuery) ([]geoPoint, error) {
+	metaKey := encodeMetaKey(c.arena, key)
+	if old, err := getMeta(c, metaKey, kTypeZset); err != nil || old == nil {
+		return nil, err
+	}
+	if q.member != nil {
+		score, ok, err := zsetScore(c, metaKey, q.member)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, ErrGeoMember
+		}
+		q.shape.lon, q.shape.lat = geohashDecode(uint64(score))
+	}
+
+	var points []geoPoint
+	enough := func() bool { return q.any && len(points) >= q.count }
+	for _, r := range q.shape.ranges() {
+		err := scanZset(c, metaKey, scoreBound{r[0], false}, scoreBound{r[1], true}, false, func(score float64, member []byte) bool {
+			lon, lat := geohashDecode(uint64(score))
+			if dist, ok := q.shape.contains(lon, lat); ok {
+				points = append(points, geoPoint{member, uint64(score), dist, lon, lat})
+			}
+			return !enough()
+		})
+		if err != nil {
+			return nil, err
+		} else if enough() {
+			break
+		}
+	}
+
+	if q.sort == 0 && q.count > 0 && !q.any {
+		q.sort = 1
+	}
+	if q.sort != 0 {
+		sort.SliceStable(points, func(i, j int) bool {
+			if q.sort < 0 {
+				return points[i].dist > points[j].dist
+			}
+			return points[i].dist < points[j].dist
+		})
+	}
+	if q.count > 0 && len(points) > q.count {
+		points = points[:q.count]
+	}
+	return points, nil
+}
+
+// search key, reply the members found or store them
+func (h *DbHandler) geoQueryReply(c *redisClient, key []byte, q *geoQuery) (Reply, error) {
+	if q.store != nil {
+		defer locks.lock(c, q.store, key)()
+	}
+	defer h.compactView(c)()
+	points, err := h.geoSearch(c, key, q)
+	if err != nil {
+		return nil, err
+	}
+
+	if q.store != nil {
+		scores, members := make([]float64, len(points)), make([][]byte, len(points))
+		for i, p := range points {
+			scores[i], members[i] = float64(p.hash), p.member
+			if q.storeDist {
+				scores[i] = p.dist / q.unit
+			}
+		}
+		n, err := h.storeZset(c, q.store, scores, members)
+		return IntReply{n}, err
+	}
+
+	replies := make([]Reply, len(points))
+	for i, p := range points {
+		if !q.withDist && !q.withHash && !q.withCoord {
+			replies[i] = BulkReply{p.member}
+			continue
+		}
+		item := []Reply{BulkReply{p.member}}
+		if q.withDist {
+			item = append(item, BulkReply{formatDistance(p.dist, q.unit)})
+		}
+		if q.withHash {
+			item = append(item, IntReply{int(p.hash)})
+		}
+		if q.withCoord {
+			item = append(item, MultiBulkReply{[][]byte{formatCoordinate(p.lon), formatCoordinate(p.lat)}})
+		}
+		replies[i] = ArrayReply{item}
+	}
+	return ArrayReply{replies}, nil
+}
+
+// GEORADIUS key longitude latitude radius M|KM|FT|MI [WITHCOORD] [WITHDIST]
+// [WITHHASH] [COUNT count [ANY]] [ASC|DESC] [STORE key|STOREDIST key]
+func (h *DbHandler) Georadius(c *redisClient, key, longitude, latitude, radius, unit []byte, args ...[]byte) (Reply, error) {
+	q := &geoQuery{}
+	var err error
+	if q.shape.lon, q.shape.lat, err = parseGeoPosition(longitude, latitude); err != nil {
+		return nil, err
+	} else if err = q.parseRadius(radius, unit); err != nil {
+		return nil, err
+	} else if err = q.parse(args, false); err != nil {
+		return nil, err
+	}
+	return h.geoQueryReply(c, key, q)
+}
+
+// GEORADIUSBYMEMBER key member radius M|KM|FT|MI [options of GEORADIUS]
+func (h *DbHandler) Georadiusbymember(c *redisClient, key, member, radius, unit []byte, args ...[]byte) (Reply, error) {
+	q := &geoQuery{member: member}
+	if err := q.parseRadius(radius, unit); err != nil {
+		return nil, err
+	} else if err = q.parse(args, false); err != nil {
+		return nil, err
+	}
+	return h.geoQueryReply(c, key, q)
+}
+
+// GEOSEARCH key FROMMEMBER member|FROMLONLAT longitude latitude
+// BYRADIUS radius unit|BYBOX width height unit [ASC|DESC] [COUNT count [ANY]]
+// [WITHCOORD] [WITHDIST] [WITHHASH]
+func (h *DbHandler) Geosearch(c *redisClient, key []byte, args ...[]byte) (Reply, error) {
+	q := &geoQuery{}
+	if err := q.parse(args, true); err != nil {
+		return nil, err
+	}
+	return h.geoQueryReply(c, key, q)
+}
+
+// GEOSEARCHSTORE destination source [options of GEOSEARCH] [STOREDIST]
+func (h *DbHandler) Geosearchstore(c *redisClient, dst, key []byte, args ...[]byte) (Reply, error) {
+	q := &geoQuery{store: dst}
+	if err := q.parse(args, true); err != nil {
+		return nil, err
+	}
+	return h.geoQueryReply(c, key, q)
+}
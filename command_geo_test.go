@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// the members in a GEORADIUS or GEOSEARCH reply, with the fields asked for, joined by spaces
+func geoReplyString(r Reply) string {
+	var parts []string
+	for _, item := range r.(ArrayReply).replies {
+		switch item := item.(type) {
+		case BulkReply:
+			parts = append(parts, string(item.value))
+		case ArrayReply:
+			for _, f := range item.replies {
+				switch f := f.(type) {
+				case BulkReply:
+					parts = append(parts, string(f.value))
+				case IntReply:
+					parts = append(parts, strconv.Itoa(f.number))
+				case MultiBulkReply:
+					parts = append(parts, string(bytes.Join(f.values, []byte(","))))
+				}
+			}
+		}
+	}
+	return fmt.Sprint(parts)
+}
+
+func TestGeoCommands(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+	args := func(s string) [][]byte {
+		return bytes.Fields([]byte(s))
+	}
+	key := []byte("Sicily")
+
+	if n, _ := h.Geoadd(c, key, args("13.361389 38.115556 Palermo 15.087269 37.502669 Catania")...); n != 2 {
+		t.Errorf("expect 2, get %v", n)
+	}
+	if r, _ := h.Zscore(c, key, []byte("Palermo")); string(r) != string(formatScore(3479099956230698)) {
+		t.Errorf("expect the hash of redis, get %s", r)
+	}
+	for unit, expect := range map[string]string{"m": "166274.1516", "KM": "166.2742", "mi": "103.3182"} {
+		if d, _ := h.Geodist(c, key, []byte("Palermo"), []byte("Catania"), []byte(unit)); string(d) != expect {
+			t.Errorf("%s: expect %s, get %s", unit, expect, d)
+		}
+	}
+	if d, _ := h.Geodist(c, key, []byte("Palermo"), []byte("missing")); d != nil {
+		t.Errorf("expect nil, get %s", d)
+	}
+	r, _ := h.Geopos(c, key, []byte("Palermo"), []byte("missing"))
+	if pos := r.(ArrayReply).replies; len(pos) != 2 || pos[1].(ArrayReply).replies != nil ||
+		string(bytes.Join(pos[0].(MultiBulkReply).values, []byte(" "))) != "13.36138933897018433 38.11555639549629859" {
+		t.Errorf("expect the position of Palermo and nil, get %v", pos)
+	}
+
+	for _, tc := range []struct {
+		args, expect string
+	}{
+		{"15 37 200 km WITHDIST ASC", "[Catania 56.4413 Palermo 190.4424]"},
+		{"15 37 200 km WITHHASH DESC COUNT 1", "[Palermo 3479099956230698]"},
+		{"15 37 100 km WITHCOORD", "[Catania 15.08726745843887329,37.50266842333162032]"},
+		{"15 37 10 km", "[]"},
+	} {
+		a := args(tc.args)
+		r, err := h.Georadius(c, key, a[0], a[1], a[2], a[3], a[4:]...)
+		if err != nil || geoReplyString(r) != tc.expect {
+			t.Errorf("georadius %s: expect %s, get %v %v", tc.args, tc.expect, geoReplyString(r), err)
+		}
+	}
+
+	h.Geoadd(c, key, args("12.758489 38.788135 edge1 17.241510 38.788135 edge2 13.583333 37.316667 Agrigento")...)
+	for _, tc := range []struct {
+		args, expect string
+	}{
+		{"FROMLONLAT 15 37 BYRADIUS 200 km ASC", "[Catania Agrigento Palermo]"},
+		{"FROMLONLAT 15 37 BYBOX 400 400 km ASC WITHDIST", "[Catania 56.4413 Agrigento 130.4235 Palermo 190.4424 edge2 279.7403 edge1 279.7405]"},
+		{"FROMMEMBER Agrigento BYRADIUS 100 km ASC", "[Agrigento Palermo]"},
+		{"FROMMEMBER Agrigento BYBOX 1 1 m", "[Agrigento]"},
+	} {
+		r, err := h.Geosearch(c, key, args(tc.args)...)
+		if err != nil || geoReplyString(r) != tc.expect {
+			t.Errorf("geosearch %s: expect %s, get %v %v", tc.args, tc.expect, geoReplyString(r), err)
+		}
+	}
+
+	if r, _ := h.Georadiusbymember(c, key, []byte("Agrigento"), []byte("100"), []byte("km"), args("STOREDIST near")...); r != (IntReply{2}) {
+		t.Errorf("expect 2 stored, get %v", r)
+	}
+	if r, _ := h.Zrange(c, []byte("near"), 0, -1, []byte("WITHSCORES")); len(r) != 4 || string(r[0]) != "Agrigento" || string(r[1]) != "0" {
+		t.Errorf("expect distances in km, get %q", r)
+	}
+	if r, _ := h.Geosearchstore(c, []byte("near"), key, args("FROMLONLAT 15 37 BYRADIUS 1 km")...); r != (IntReply{0}) {
+		t.Errorf("expect 0 stored, get %v", r)
+	}
+	if n, _ := h.Exists(c, []byte("near")); n != 0 {
+		t.Errorf("expect near deleted, get %v", n)
+	}
+
+	for s, err := range map[string]error{
+		"FROMLONLAT 15 37":                           ErrGeoShape,
+		"FROMLONLAT 15 37 FROMMEMBER a BYRADIUS 1 m": ErrGeoShape,
+		"FROMLONLAT 15 37 BYRADIUS 1 parsec":         ErrGeoUnit,
+		"FROMLONLAT 15 37 BYRADIUS -1 m":             ErrGeoNegative,
+		"FROMLONLAT 181 37 BYRADIUS 1 m":             ErrGeoPosition,
+		"FROMLONLAT 15 37 BYRADIUS 1 m ANY":          ErrGeoAny,
+		"FROMLONLAT 15 37 BYRADIUS 1 m COUNT 0":      ErrCountNotPositive,
+		"FROMLONLAT 15 37 BYRADIUS 1 m STOREDIST":    ErrSyntax,
+		"FROMMEMBER missing BYRADIUS 1 m":            ErrGeoMember,
+	} {
+		if _, e := h.Geosearch(c, key, args(s)...); e != err {
+			t.Errorf("geosearch %s: expect %v, get %v", s, err, e)
+		}
+	}
+	if _, err := h.Georadius(c, key, []byte("15"), []byte("37"), []byte("1"), []byte("km"), args("WITHDIST STORE x")...); err != ErrGeoStoreWith {
+		t.Errorf("expect store error, get %v", err)
+	}
+	if _, err := h.Geoadd(c, key, args("15 86 north")...); err != ErrGeoPosition {
+		t.Errorf("expect position error, get %v", err)
+	}
+}
+
+// searches find what checking every member finds, anywhere on earth
+func TestGeoSearchCoverage(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+	rnd := rand.New(rand.NewSource(1))
+	key := []byte("points")
+	lonLat := func() (float64, float64) {
+		return rnd.Float64()*360 - 180, rnd.Float64()*170 - 85
+	}
+	format := func(v float64) []byte {
+		return strconv.AppendFloat(nil, v, 'f', -1, 64)
+	}
+
+	points := make(map[string][2]float64)
+	var args [][]byte
+	for i := 0; i < 2000; i++ {
+		lon, lat := lonLat()
+		if i%4 == 0 { // crowd the antimeridian and the poles
+			lon = 179.5 + rnd.Float64()
+			if lon > 180 {
+				lon -= 360
+			}
+		} else if i%4 == 1 {
+			lat = 84 * (1 - 2*float64(rnd.Intn(2))) * (1 + rnd.Float64()/84)
+		}
+		name := strconv.Itoa(i)
+		args = append(args, format(lon), format(lat), []byte(name))
+		x, y := geohashDecode(geohashEncode(lon, lat)) // where it's saved
+		points[name] = [2]float64{x, y}
+	}
+	h.Geoadd(c, key, args...)
+
+	for i := 0; i < 200; i++ {
+		lon, lat := lonLat()
+		if i%2 == 0 {
+			lon, lat = 180, 80*(1-2*float64(rnd.Intn(2)))
+		}
+		shape := geoShape{lon: lon, lat: lat}
+		a := [][]byte{[]byte("FROMLONLAT"), format(lon), format(lat)}
+		size := []float64{1, 100, 1000, 10000}[i%4] * (1 + rnd.Float64())
+		if i%3 == 0 {
+			shape.width, shape.height = size*1000, size*500
+			a = append(a, []byte("BYBOX"), format(size), format(size/2), []byte("km"))
+		} else {
+			shape.radius = size * 1000
+			a = append(a, []byte("BYRADIUS"), format(size), []byte("km"))
+		}
+
+		var expect []string
+		for name, p := range points {
+			if _, ok := shape.contains(p[0], p[1]); ok {
+				expect = append(expect, name)
+			}
+		}
+		r, err := h.Geosearch(c, key, a...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found []string
+		for _, m := range r.(ArrayReply).replies {
+			found = append(found, string(m.(BulkReply).value))
+		}
+		sort.Strings(expect)
+		sort.Strings(found)
+		if fmt.Sprint(expect) != fmt.Sprint(found) {
+			t.Errorf("%q: expect %v, get %v", a, expect, found)
+		}
+	}
+}
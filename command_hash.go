@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+)
+
+// call fn with (member, value) of every member key under prefix, in member order, until fn returns false
+func scanMembers(c *redisClient, prefix []byte, fn func(member, value []byte) bool) error {
+	return scanMembersFrom(c, prefix, prefix, fn)
+}
+
+// like scanMembers, but seek to start first
+func scanMembersFrom(c *redisClient, prefix, start []byte, fn func(member, value []byte) bool) error {
+	return c.db.Scan(c.arena, start, func(k, v []byte) bool {
+		if !bytes.HasPrefix(k, prefix) {
+			return false
+		}
+		return fn(k[len(prefix):], v)
+	})
+}
+
+func scanHash(c *redisClient, mKey []byte, fn func(field, value []byte)) error {
+	if old, err := getMeta(c, mKey, kTypeHash); err != nil || old == nil {
+		return err
+	}
+	return scanMembers(c, hashFieldKey(c.arena, mKey, nil), func(field, value []byte) bool {
+		fn(field, value)
+		return true
+	})
+}
+
+func (h *DbHandler) Hset(c *redisClient, key []byte, fvs ...[]byte) (int, error) {
+	defer locks.lock(c, key)()
+	defer h.compactView(c)()
+	if len(fvs) == 0 || len(fvs)%2 != 0 {
+		return 0, ErrWrongArgsNumber
+	}
+
+	metaKey := encodeMetaKey(c.arena, key)
+	old, err := getMeta(c, metaKey, kTypeHash)
+	if err != nil {
+		return 0, err
+	}
+	hash := Hash(old)
+	if old == nil {
+		hash = NewHash(c.arena)
+	}
+
+	ks, vs := createKvs(len(fvs)/2 + 1)
+	ks[0], vs[0] = metaKey, hash
+	added, seen := 0, make(map[string]bool, len(fvs)/2)
+	for i := 0; i < len(fvs); i += 2 {
+		fKey := hashFieldKey(c.arena, metaKey, fvs[i])
+		ks[i/2+1], vs[i/2+1] = fKey, fvs[i+1]
+
+		if seen[string(fvs[i])] {
+			continue
+		}
+		seen[string(fvs[i])] = true
+		if old == nil {
+			added += 1
+		} else if v, err := c.db.Get(c.arena, fKey); err != nil {
+			return 0, err
+		} else if v == nil {
+			added += 1
+		}
+	}
+
+	hash.setSize(hash.size() + added)
+	return added, c.db.Batch(ks, vs)
+}
+
+func (h *DbHandler) Hmset(c *redisClient, key []byte, fvs ...[]byte) error {
+	_, err := h.Hset(c, key, fvs...)
+	return err
+}
+
+func (h *DbHandler) Hget(c *redisClient, key, field []byte) ([]byte, error) {
+	defer h.compactView(c)()
+	metaKey := encodeMetaKey(c.arena, key)
+	if old, err := getMeta(c, metaKey, kTypeHash); err != nil || old == nil {
+		return nil, err
+	}
+	return c.db.Get(c.arena, hashFieldKey(c.arena, metaKey, field))
+}
+
+func (h *DbHandler) Hmget(c *redisClient, key []byte, fields ...[]byte) ([][]byte, error) {
+	defer h.compactView(c)()
+	metaKey := encodeMetaKey(c.arena, key)
+	result := make([][]byte, len(fields))
+	if old, err := getMeta(c, metaKey, kTypeHash); err != nil || old == nil {
+		return result, err
+	}
+	for i, field := range fields {
+		if v, err := c.db.Get(c.arena, hashFieldKey(c.arena, metaKey, field)); err != nil {
+			return nil, err
+		} else {
+			result[i] = v
+		}
+	}
+	return result, nil
+}
+
+func (h *DbHandler) Hdel(c *redisClient, key []byte, fields ...[]byte) (int, error) {
+	defer locks.lock(c, key)()
+	defer h.compactView(c)()
+	metaKey := encodeMetaKey(c.arena, key)
+	if old, err := getMeta(c, metaKey, kTypeHash); err != nil || old == nil {
+		return 0, err
+	} else {
+		hash := Hash(old)
+		ks, vs := createKvs(len(fields) + 1)
+		ks[0], vs[0] = metaKey, hash
+		deleted, n := 0, 1
+		for _, field := range fields {
+			fKey := hashFieldKey(c.arena, metaKey, field)
+			if v, err := c.db.Get(c.arena, fKey); err != nil {
+				return 0, err
+			} else if v != nil && !containsKey(ks[1:n], fKey) {
+				ks[n] = fKey
+				n += 1
+				deleted += 1
+			}
+		}
+
+		if deleted == 0 {
+			return 0, nil
+		}
+		if deleted == hash.size() {
+			vs[0] = nil // the last field is gone, remove the hash
+		} else {
+			hash.setSize(hash.size() - deleted)
+		}
+		return deleted, c.db.Batch(ks[:n], vs[:n])
+	}
+}
+
+func containsKey(ks [][]byte, key []byte) bool {
+	for _, k := range ks {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *DbHandler) Hlen(c *redisClient, key []byte) (int, error) {
+	if old, err := getMeta(c, encodeMetaKey(c.arena, key), kTypeHash); err != nil || old == nil {
+		return 0, err
+	} else {
+		return Hash(old).size(), nil
+	}
+}
+
+func (h *DbHandler) Hexists(c *redisClient, key, field []byte) (int, error) {
+	if v, err := h.Hget(c, key, field); err != nil || v == nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// read, add incr and write back the field, all under the lock of key
+func (h *DbHandler) Hincrby(c *redisClient, key, field []byte, incr int) (int, error) {
+	defer locks.lock(c, key)()
+	defer h.compactView(c)()
+	old, err := h.Hget(c, key, field)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if old != nil {
+		if n, err = strconv.ParseInt(string(old), 10, 64); err != nil {
+			return 0, ErrExpectInteger
+		}
+	}
+	delta := int64(incr)
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrIncrOverflow
+	}
+	n += delta
+	_, err = h.Hset(c, key, field, strconv.AppendInt(nil, n, 10))
+	return int(n), err
+}
+
+func (h *DbHandler) Hgetall(c *redisClient, key []byte) ([][]byte, error) {
+	defer h.compactView(c)()
+	result := make([][]byte, 0)
+	err := scanHash(c, encodeMetaKey(c.arena, key), func(field, value []byte) {
+		result = append(result, field, value)
+	})
+	return result, err
+}
+
+func (h *DbHandler) Hkeys(c *redisClient, key []byte) ([][]byte, error) {
+	defer h.compactView(c)()
+	result := make([][]byte, 0)
+	err := scanHash(c, encodeMetaKey(c.arena, key), func(field, value []byte) {
+		result = append(result, field)
+	})
+	return result, err
+}
+
+func (h *DbHandler) Hvals(c *redisClient, key []byte) ([][]byte, error) {
+	defer h.compactView(c)()
+	result := make([][]byte, 0)
+	err := scanHash(c, encodeMetaKey(c.arena, key), func(field, value []byte) {
+		result = append(result, value)
+	})
+	return result, err
+}
+
+// HSCAN key cursor [MATCH pattern] [COUNT count]
+func (h *DbHandler) Hscan(c *redisClient, key, cursor []byte, args ...[]byte) (Reply, error) {
+	defer h.compactView(c)()
+	return scanCollection(c, key, kTypeHash, kHashFieldKeyPrefix, cursor, args,
+		func(out [][]byte, field, value []byte) [][]byte {
+			return append(out, field, value)
+		})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// a client backed by a fresh RockdbStore in a temp dir, call the returned func to clean up
+func newTestClient(t testing.TB) (*DbHandler, *redisClient, func()) {
+	path, err := ioutil.TempDir("", "rockredis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewRockdbStore(path, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewReisClient(&MockConn{})
+	c.db = db
+	return &DbHandler{}, c, func() {
+		db.Close()
+		os.RemoveAll(path)
+	}
+}
+
+func TestHashCommands(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+
+	key := []byte("user")
+	if n, err := h.Hset(c, key, []byte("name"), []byte("feng"), []byte("age"), []byte("30")); n != 2 || err != nil {
+		t.Errorf("expect 2 fields added, get %v, %v", n, err)
+	}
+	if n, err := h.Hset(c, key, []byte("name"), []byte("shen")); n != 0 || err != nil {
+		t.Errorf("expect 0 fields added, get %v, %v", n, err)
+	}
+	if v, err := h.Hget(c, key, []byte("name")); string(v) != "shen" || err != nil {
+		t.Errorf("expect shen, get %s, %v", v, err)
+	}
+	if n, err := h.Hincrby(c, key, []byte("age"), 2); n != 32 || err != nil {
+		t.Errorf("expect 32, get %v, %v", n, err)
+	}
+
+	// a key sharing the prefix should not leak into the scan
+	h.Hset(c, []byte("users"), []byte("x"), []byte("y"))
+	if all, err := h.Hgetall(c, key); len(all) != 4 || err != nil {
+		t.Errorf("expect 2 pairs, get %q, %v", all, err)
+	} else if string(all[0]) != "age" || string(all[1]) != "32" {
+		t.Errorf("expect fields in order, get %q", all)
+	}
+
+	if n, err := h.Hdel(c, key, []byte("name"), []byte("name"), []byte("none")); n != 1 || err != nil {
+		t.Errorf("expect 1 field deleted, get %v, %v", n, err)
+	}
+	if n, _ := h.Hlen(c, key); n != 1 {
+		t.Errorf("expect 1 field left, get %v", n)
+	}
+	h.Hdel(c, key, []byte("age"))
+	if n, _ := h.Hlen(c, key); n != 0 {
+		t.Errorf("expect hash removed, get %v", n)
+	}
+
+	// an empty value is a value, in member keys too
+	long := bytes.Repeat([]byte("v"), kMaxCompactValue+1)
+	for _, k := range []string{"small", "big"} {
+		h.Hset(c, []byte(k), []byte("e"), []byte{})
+		if k == "big" {
+			h.Hset(c, []byte(k), []byte("long"), long)
+		}
+		h.Hset(c, []byte(k), []byte("e"), []byte{})
+		if v, err := h.Hget(c, []byte(k), []byte("e")); v == nil || len(v) != 0 || err != nil {
+			t.Errorf("%s: expect an empty value, get %q, %v", k, v, err)
+		}
+		if n, _ := h.Hexists(c, []byte(k), []byte("e")); n != 1 {
+			t.Errorf("%s: expect the field, get %v", k, n)
+		}
+		if n, _ := h.Hdel(c, []byte(k), []byte("e")); n != 1 {
+			t.Errorf("%s: expect 1 field deleted, get %v", k, n)
+		}
+	}
+	if n, _ := h.Hlen(c, []byte("big")); n != 1 {
+		t.Errorf("expect 1 field left, get %v", n)
+	}
+}
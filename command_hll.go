@@ -0,0 +1,88 @@
+package main
+
+// the HyperLogLog at key, nil if key is missing
+func getHll(c *redisClient, key []byte) (mKey, meta []byte, l *hyperLogLog, err error) {
+	mKey, meta, value, err := getString(c, key)
+	if err != nil || meta == nil {
+		return mKey, meta, nil, err
+	}
+	l, err = decodeHll(value)
+	return mKey, meta, l, err
+}
+
+// PFADD key [element ...], 1 if key is new or a register changed
+func (h *DbHandler) Pfadd(c *redisClient, key []byte, elements ...[]byte) (int, error) {
+	defer locks.lock(c, key)()
+	mKey, old, l, err := getHll(c, key)
+	if err != nil {
+		return 0, err
+	}
+	changed := l == nil
+	if l == nil {
+		l = &hyperLogLog{}
+	}
+	for _, e := range elements {
+		if l.regs.add(e) {
+			changed = true
+		}
+	}
+	if !changed {
+		return 0, nil
+	}
+	l.cached = false
+	return 1, updateString(c, mKey, old, l.encode())
+}
+
+// PFCOUNT key [key ...], the cardinality of the union. The count of a single
+// key is cached in it, like redis does
+func (h *DbHandler) Pfcount(c *redisClient, keys ...[]byte) (int, error) {
+	if len(keys) == 0 {
+		return 0, ErrWrongArgsNumber
+	}
+	if len(keys) == 1 {
+		defer locks.lock(c, keys[0])()
+		mKey, old, l, err := getHll(c, keys[0])
+		if err != nil || l == nil {
+			return 0, err
+		}
+		if !l.cached {
+			l.card, l.cached = l.regs.count(), true
+			if err := updateString(c, mKey, old, l.encode()); err != nil {
+				return 0, err
+			}
+		}
+		return int(l.card), nil
+	}
+
+	var union hllRegisters
+	for _, key := range keys {
+		_, _, l, err := getHll(c, key)
+		if err != nil {
+			return 0, err
+		} else if l != nil {
+			union.merge(&l.regs)
+		}
+	}
+	return int(union.count()), nil
+}
+
+// PFMERGE destkey [sourcekey ...], the union of all, destkey included, is saved in destkey
+func (h *DbHandler) Pfmerge(c *redisClient, dst []byte, keys ...[]byte) error {
+	defer locks.lock(c, append([][]byte{dst}, keys...)...)()
+	mKey, old, l, err := getHll(c, dst)
+	if err != nil {
+		return err
+	} else if l == nil {
+		l = &hyperLogLog{}
+	}
+	for _, key := range keys {
+		_, _, src, err := getHll(c, key)
+		if err != nil {
+			return err
+		} else if src != nil {
+			l.regs.merge(&src.regs)
+		}
+	}
+	l.cached = false
+	return updateString(c, mKey, old, l.encode())
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestMurmurHash64A(t *testing.T) {
+	for s, expect := range map[string]uint64{
+		"":                 15627466953755236146,
+		"a":                6039968161137406375,
+		"hello":            1109414937308947456,
+		"hello world 123":  9146052980778294115,
+		"0123456789abcdef": 11494704960468834109,
+	} {
+		if h := murmurHash64A([]byte(s), 0xadc83b19); h != expect {
+			t.Errorf("%q: expect %d, get %d", s, expect, h)
+		}
+	}
+}
+
+func TestHyperLogLog(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+	elements := func(from, to int) [][]byte {
+		var es [][]byte
+		for i := from; i < to; i++ {
+			es = append(es, []byte(strconv.Itoa(i)))
+		}
+		return es
+	}
+	encoding := func(key string) byte {
+		v, _ := h.Get(c, []byte(key))
+		return v[4]
+	}
+
+	if n, _ := h.Pfadd(c, []byte("a")); n != 1 {
+		t.Errorf("expect created, get %v", n)
+	}
+	if v, _ := h.Get(c, []byte("a")); string(v) != "HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x80\x7f\xff" {
+		t.Errorf("expect an empty sparse HyperLogLog, get %q", v)
+	}
+	if n, _ := h.Pfadd(c, []byte("a"), elements(0, 7)...); n != 1 {
+		t.Errorf("expect changed, get %v", n)
+	}
+	if n, _ := h.Pfadd(c, []byte("a"), elements(0, 7)...); n != 0 {
+		t.Errorf("expect unchanged, get %v", n)
+	}
+	if n, _ := h.Pfcount(c, []byte("a")); n != 7 {
+		t.Errorf("expect 7, get %v", n)
+	}
+	if v, _ := h.Get(c, []byte("a")); v[15]&0x80 != 0 || v[8] != 7 {
+		t.Errorf("expect 7 cached, get %q", v[8:16])
+	}
+
+	// sparse, till it's too long
+	h.Pfadd(c, []byte("a"), elements(7, 100)...)
+	if e := encoding("a"); e != kHllSparse {
+		t.Errorf("expect sparse, get %v", e)
+	}
+	h.Pfadd(c, []byte("a"), elements(100, 10000)...)
+	if e := encoding("a"); e != kHllDense {
+		t.Errorf("expect dense, get %v", e)
+	}
+	if n, _ := h.Pfcount(c, []byte("a")); n < 9800 || n > 10200 {
+		t.Errorf("expect about 10000, get %v", n)
+	}
+
+	h.Pfadd(c, []byte("b"), elements(5000, 15000)...)
+	if n, _ := h.Pfcount(c, []byte("a"), []byte("b"), []byte("missing")); n < 14700 || n > 15300 {
+		t.Errorf("expect about 15000, get %v", n)
+	}
+	h.Pfadd(c, []byte("d"), []byte("x"))
+	h.Expire(c, []byte("d"), 100)
+	if err := h.Pfmerge(c, []byte("d"), []byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := h.Pfcount(c, []byte("d")); n < 14700 || n > 15300 {
+		t.Errorf("expect about 15000, get %v", n)
+	}
+	if ttl, _ := h.Ttl(c, []byte("d")); ttl <= 0 {
+		t.Errorf("expect the ttl kept, get %v", ttl)
+	}
+	h.Pfmerge(c, []byte("new"))
+	if n, _ := h.Pfcount(c, []byte("new")); n != 0 {
+		t.Errorf("expect an empty HyperLogLog, get %v", n)
+	}
+
+	// a dense value written by redis reads the same
+	v, _ := h.Get(c, []byte("d"))
+	h.Set(c, []byte("copy"), v)
+	if n, _ := h.Pfadd(c, []byte("copy"), elements(0, 100)...); n != 0 {
+		t.Errorf("expect unchanged, get %v", n)
+	}
+
+	h.Set(c, []byte("s"), []byte("foo"))
+	if _, err := h.Pfadd(c, []byte("s"), []byte("x")); err != ErrNotHLL {
+		t.Errorf("expect not a HyperLogLog, get %v", err)
+	}
+	h.Set(c, []byte("s"), []byte("HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x80\x7f\xfe"))
+	if _, err := h.Pfcount(c, []byte("s")); err != ErrInvalidHLL {
+		t.Errorf("expect corrupted, get %v", err)
+	}
+	h.Sadd(c, []byte("set"), []byte("x"))
+	if err := h.Pfmerge(c, []byte("a"), []byte("set")); err != ErrWrongType {
+		t.Errorf("expect wrong type, get %v", err)
+	}
+}
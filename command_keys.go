@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// collections bigger than this are unlinked in the background
+const unlinkSyncMax = 64
+
+func (h *DbHandler) Del(c *redisClient, keys ...[]byte) (int, error) {
+	defer locks.lock(c, keys...)()
+	deleted := 0
+	for _, key := range keys {
+		if mKey, meta, err := findKey(c, key); err != nil {
+			return deleted, err
+		} else if mKey != nil {
+			if err := deleteKey(c, mKey, meta); err != nil {
+				return deleted, err
+			}
+			deleted += 1
+		}
+	}
+	return deleted, nil
+}
+
+// a key given n times is counted n times
+func (h *DbHandler) Exists(c *redisClient, keys ...[]byte) (int, error) {
+	found := 0
+	for _, key := range keys {
+		if mKey, _, err := findKey(c, key); err != nil {
+			return found, err
+		} else if mKey != nil {
+			found += 1
+		}
+	}
+	return found, nil
+}
+
+// like DEL, but only the meta key of a big collection is deleted right away, its data keys are deleted in the background
+func (h *DbHandler) Unlink(c *redisClient, keys ...[]byte) (int, error) {
+	defer locks.lock(c, keys...)()
+	deleted := 0
+	for _, key := range keys {
+		mKey, meta, err := findKey(c, key)
+		if err != nil {
+			return deleted, err
+		} else if mKey == nil {
+			continue
+		}
+
+		// in EXEC, everything goes into its batch
+		if metaType(meta) == kTypeString || metaSize(meta) <= unlinkSyncMax || c.writes != nil {
+			err = deleteKey(c, mKey, meta)
+		} else {
+			err = unlinking.unlink(c.db, mKey, meta)
+		}
+		if err != nil {
+			return deleted, err
+		}
+		deleted += 1
+	}
+	return deleted, nil
+}
+
+// Keys whose data keys are being deleted in the background, by db. A new key
+// with the same name would share its data keys, so getMeta waits for them to go
+// when called by a writer
+type unlinker struct {
+	sync.Mutex
+	pending map[Store]map[string]chan struct{}
+}
+
+var unlinking = &unlinker{pending: make(map[Store]map[string]chan struct{})}
+
+// block until the background delete of mKey, if any, is done
+func (u *unlinker) wait(db Store, mKey []byte) {
+	u.Lock()
+	done, ok := u.pending[baseStore(db)][string(mKey)]
+	u.Unlock()
+	if ok {
+		<-done
+	}
+}
+
+func (u *unlinker) unlink(db Store, mKey, meta []byte) error {
+	// the arena is reused by the next request
+	mKey, meta = append([]byte{}, mKey...), append([]byte{}, meta...)
+	done := make(chan struct{})
+	u.Lock()
+	if u.pending[db] == nil {
+		u.pending[db] = make(map[string]chan struct{})
+	}
+	u.pending[db][string(mKey)] = done
+	u.Unlock()
+
+	if err := db.Delete(mKey); err != nil {
+		u.finish(db, mKey, done)
+		return err
+	}
+
+	go func() {
+		defer u.finish(db, mKey, done)
+		c := &redisClient{db: db, arena: NewArena(1024 * 32)}
+		ks, _, err := keyRecords(c, mKey, meta, false)
+		for i := 1; i < len(ks) && err == nil; i += sweepBatch { // ks[0] is the meta key
+			end := i + sweepBatch
+			if end > len(ks) {
+				end = len(ks)
+			}
+			err = db.Batch(ks[i:end], make([][]byte, end-i))
+		}
+		if err != nil {
+			log.Printf("Unlink %q, get error: %v", mKey[1:], err)
+		}
+	}()
+	return nil
+}
+
+// block until no delete is left in the background, before the dbs are closed
+func (u *unlinker) drain() {
+	for {
+		var done chan struct{}
+		u.Lock()
+		for _, keys := range u.pending {
+			for _, ch := range keys {
+				done = ch
+				break
+			}
+			if done != nil {
+				break
+			}
+		}
+		u.Unlock()
+		if done == nil {
+			return
+		}
+		<-done
+	}
+}
+
+func (u *unlinker) finish(db Store, mKey []byte, done chan struct{}) {
+	u.Lock()
+	delete(u.pending[db], string(mKey))
+	u.Unlock()
+	close(done)
+}
+
+var typeNames = map[byte]string{
+	kTypeString: "string",
+	kTypeList:   "list",
+	kTypeHash:   "hash",
+	kTypeSet:    "set",
+	kTypeZset:   "zset",
+	kTypeBitmap: "string",
+}
+
+func (h *DbHandler) Type(c *redisClient, key []byte) (Reply, error) {
+	if mKey, meta, err := findKey(c, key); err != nil || mKey == nil {
+		return StatusReply{"none"}, err
+	} else {
+		return StatusReply{typeNames[metaType(meta)]}, nil
+	}
+}
+
+type scanOptions struct {
+	match []byte
+	count int
+	typ   string // only keys of this type, SCAN only
+}
+
+func parseScanOptions(args [][]byte, allowType bool) (opts scanOptions, err error) {
+	opts.count = 10
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return opts, ErrSyntax
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			opts.match = args[i+1]
+		case "COUNT":
+			if opts.count, err = strconv.Atoi(string(args[i+1])); err != nil || opts.count < 1 {
+				return opts, ErrSyntax
+			}
+		case "TYPE":
+			if !allowType {
+				return opts, ErrSyntax
+			}
+			opts.typ = strings.ToLower(string(args[i+1]))
+		default:
+			return opts, ErrSyntax
+		}
+	}
+	return
+}
+
+// The cursor is where the scan stopped: the last rocksdb key returned, after
+// the prefix scanned, as an unsigned 64 bit integer. One up to kCursorKeyMax
+// bytes goes in the cursor itself: the top bit set, 3 bits of length, 12 bits
+// of the prefix's hash to catch a cursor of another collection, then the
+// bytes. A longer one is kept by the connection under a smaller id, until the
+// scan is resumed. 0 is left for start and end.
+const (
+	kCursorKeyMax    = 6
+	kCursorInKey     = 1 << 63
+	kClientCursorMax = 1024 // unfinished scans of long keys a connection keeps
+)
+
+func cursorCheck(prefix []byte) uint64 {
+	h := fnv.New32a()
+	h.Write(prefix)
+	return uint64(h.Sum32() & 0xfff)
+}
+
+// the cursor to resume a scan of prefix right after key
+func (c *redisClient) encodeCursor(prefix, key []byte) []byte {
+	rest := key[len(prefix):]
+	if len(rest) <= kCursorKeyMax {
+		var payload [8]byte
+		copy(payload[2:], rest)
+		v := kCursorInKey | uint64(len(rest))<<60 | cursorCheck(prefix)<<48 | bigEndian.Uint64(payload[:])
+		return strconv.AppendUint(nil, v, 10)
+	}
+	if c.cursors == nil {
+		c.cursors = make(map[uint64][]byte)
+	}
+	if len(c.cursors) >= kClientCursorMax { // the oldest scan left unfinished goes
+		oldest := c.lastCursor
+		for id := range c.cursors {
+			if id < oldest {
+				oldest = id
+			}
+		}
+		delete(c.cursors, oldest)
+	}
+	c.lastCursor++
+	c.cursors[c.lastCursor] = append([]byte{}, key...)
+	return strconv.AppendUint(nil, c.lastCursor, 10)
+}
+
+// where to resume a scan of prefix, right after the key of the cursor
+func (c *redisClient) decodeCursor(cursor, prefix []byte) ([]byte, error) {
+	if len(cursor) == 1 && cursor[0] == '0' {
+		return prefix, nil
+	}
+	v, err := strconv.ParseUint(string(cursor), 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if v&kCursorInKey == 0 {
+		key, ok := c.cursors[v]
+		if !ok || !bytes.HasPrefix(key, prefix) {
+			return nil, ErrInvalidCursor
+		}
+		delete(c.cursors, v) // resumed, the next cursor takes over
+		return append(key, 0), nil
+	}
+	n := int(v >> 60 & 7)
+	var payload [8]byte
+	bigEndian.PutUint64(payload[:], v)
+	if n > kCursorKeyMax || v>>48&0xfff != cursorCheck(prefix) ||
+		bigEndian.Uint64(payload[:])&(1<<uint(8*(kCursorKeyMax-n))-1) != 0 {
+		return nil, ErrInvalidCursor
+	}
+	key := make([]byte, 0, len(prefix)+n+1)
+	key = append(append(key, prefix...), payload[2:2+n]...)
+	return append(key, 0), nil
+}
+
+// Look at up to count keys under prefix after cursor, fn is called for each.
+// Returns the cursor to continue with, "0" when prefix is exhausted.
+func scanCursor(c *redisClient, prefix, cursor []byte, count int,
+	fn func(key, value []byte)) ([]byte, error) {
+	start, err := c.decodeCursor(cursor, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var last []byte
+	seen := 0
+	err = c.db.ScanRange(c.arena, start, prefixEnd(prefix), false, func(k, v []byte) bool {
+		fn(k, v)
+		last, seen = k, seen+1
+		return seen < count
+	})
+	if err != nil || seen < count {
+		return []byte("0"), err
+	}
+	return c.encodeCursor(prefix, last), nil
+}
+
+// HSCAN, SSCAN and ZSCAN: walk the member keys of the collection at key.
+// reply appends what is returned for each member matching MATCH. The cursor
+// carries the member to resume from, like the one of SCAN.
+func scanCollection(c *redisClient, key []byte, typ, prefix byte, cursor []byte, args [][]byte,
+	reply func(out [][]byte, member, value []byte) [][]byte) (Reply, error) {
+	opts, err := parseScanOptions(args, false)
+	if err != nil {
+		return nil, err
+	}
+	mKey := encodeMetaKey(c.arena, key)
+	out := make([][]byte, 0)
+	if meta, err := getMeta(c, mKey, typ); err != nil {
+		return nil, err
+	} else if meta == nil {
+		return ArrayReply{[]Reply{BulkReply{[]byte("0")}, MultiBulkReply{out}}}, nil
+	}
+	start := memberKey(c.arena, prefix, mKey, nil)
+	next, err := scanCursor(c, start, cursor, opts.count, func(k, v []byte) {
+		member := k[len(start):]
+		if opts.match == nil || globMatch(opts.match, member) {
+			out = reply(out, member, v)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ArrayReply{[]Reply{BulkReply{next}, MultiBulkReply{out}}}, nil
+}
+
+// logical keys live in the meta records only, data keys are never looked at
+func scanKeys(c *redisClient, cursor []byte, opts scanOptions) ([]byte, [][]byte, error) {
+	keys := make([][]byte, 0)
+	now := nowMs()
+	next, err := scanCursor(c, []byte{kMetaKeyPrefix}, cursor, opts.count, func(k, meta []byte) {
+		key := k[1:]
+		if len(meta) < kMetaHeaderSize || metaExpired(meta, now) {
+			return
+		}
+		if opts.typ != "" && typeNames[metaType(meta)] != opts.typ {
+			return
+		}
+		if opts.match == nil || globMatch(opts.match, key) {
+			keys = append(keys, key)
+		}
+	})
+	return next, keys, err
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func (h *DbHandler) Scan(c *redisClient, cursor []byte, args ...[]byte) (Reply, error) {
+	opts, err := parseScanOptions(args, true)
+	if err != nil {
+		return nil, err
+	}
+	next, keys, err := scanKeys(c, cursor, opts)
+	if err != nil {
+		return nil, err
+	}
+	return ArrayReply{[]Reply{BulkReply{next}, MultiBulkReply{keys}}}, nil
+}
+
+func (h *DbHandler) Keys(c *redisClient, pattern []byte) ([][]byte, error) {
+	_, keys, err := scanKeys(c, []byte("0"), scanOptions{match: pattern, count: int(^uint(0) >> 1)})
+	return keys, err
+}
+
+// let key expire at unix ms at, a time in the past deletes it right away
+func (h *DbHandler) expireAt(c *redisClient, key []byte, at int64) (int, error) {
+	defer locks.lock(c, key)()
+	mKey, meta, err := findKey(c, key)
+	if err != nil || mKey == nil {
+		return 0, err
+	}
+	if at <= nowMs() {
+		return 1, deleteKey(c, mKey, meta)
+	}
+	return 1, expireKey(c, mKey, meta, at)
+}
+
+func (h *DbHandler) Expire(c *redisClient, key []byte, seconds int) (int, error) {
+	return h.expireAt(c, key, nowMs()+int64(seconds)*1000)
+}
+
+func (h *DbHandler) Pexpire(c *redisClient, key []byte, ms int) (int, error) {
+	return h.expireAt(c, key, nowMs()+int64(ms))
+}
+
+func (h *DbHandler) Expireat(c *redisClient, key []byte, timestamp int) (int, error) {
+	return h.expireAt(c, key, int64(timestamp)*1000)
+}
+
+func (h *DbHandler) Pexpireat(c *redisClient, key []byte, ms int) (int, error) {
+	return h.expireAt(c, key, int64(ms))
+}
+
+// remaining ms to live, -2 if key does not exist, -1 if it never expires
+func (h *DbHandler) pttl(c *redisClient, key []byte) (int64, error) {
+	mKey, meta, err := findKey(c, key)
+	if err != nil || mKey == nil {
+		return -2, err
+	}
+	if at := metaExpireAt(meta); at == 0 {
+		return -1, nil
+	} else {
+		return at - nowMs(), nil
+	}
+}
+
+func (h *DbHandler) Ttl(c *redisClient, key []byte) (int, error) {
+	if ttl, err := h.pttl(c, key); err != nil || ttl < 0 {
+		return int(ttl), err
+	} else {
+		return int((ttl + 500) / 1000), nil
+	}
+}
+
+func (h *DbHandler) Pttl(c *redisClient, key []byte) (int, error) {
+	ttl, err := h.pttl(c, key)
+	return int(ttl), err
+}
+
+func (h *DbHandler) Persist(c *redisClient, key []byte) (int, error) {
+	defer locks.lock(c, key)()
+	mKey, meta, err := findKey(c, key)
+	if err != nil || mKey == nil || metaExpireAt(meta) == 0 {
+		return 0, err
+	}
+	// the sweeper skips the entry left in the expire index
+	setMetaExpireAt(meta, 0)
+	return 1, c.db.Set(mKey, meta)
+}
+
+func (h *DbHandler) checkDbIndex(idx int) error {
+	if idx < 0 || idx >= h.server.conf.Databases {
+		return ErrDbIndexOutOfRange
+	}
+	return nil
+}
+
+func (h *DbHandler) Select(c *redisClient, idx int) error {
+	if err := h.checkDbIndex(idx); err != nil {
+		return err
+	}
+	c.dbIdx, c.db = idx, h.server.db(idx)
+	return nil
+}
+
+// copy key with all its data keys to db idx, then delete it here. The two dbs
+// are separate rocksdb instances: a crash in between leaves a copy in both
+func (h *DbHandler) Move(c *redisClient, key []byte, idx int) (int, error) {
+	defer locks.lock(c, key)()
+	if err := h.checkDbIndex(idx); err != nil {
+		return 0, err
+	}
+	target := &redisClient{db: c.useDb(h.server.db(idx)), dbIdx: idx, arena: c.arena, locked: c.locked}
+	if target.db == c.db {
+		return 0, ErrSameObject
+	}
+
+	mKey, meta, err := findKey(c, key)
+	if err != nil || mKey == nil {
+		return 0, err
+	}
+	if tKey, _, err := findKey(target, key); err != nil || tKey != nil {
+		return 0, err // already exists in the target db
+	}
+
+	ks, vs, err := keyRecords(c, mKey, meta, true)
+	if err != nil {
+		return 0, err
+	}
+	if at := metaExpireAt(meta); at != 0 {
+		ks, vs = append(ks, expireIndexKey(c.arena, at, mKey)), append(vs, []byte{})
+	}
+	if err := target.db.Batch(ks, vs); err != nil {
+		return 0, err
+	}
+	return 1, deleteKey(c, mKey, meta)
+}
+
+func (h *DbHandler) Swapdb(c *redisClient, i, j int) error {
+	if err := h.checkDbIndex(i); err != nil {
+		return err
+	}
+	if err := h.checkDbIndex(j); err != nil {
+		return err
+	}
+	if i == j {
+		return nil
+	}
+	return h.server.swapDb(i, j)
+}
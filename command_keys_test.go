@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpire(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+
+	h.Set(c, []byte("k"), []byte("v"))
+	if n, _ := h.Ttl(c, []byte("k")); n != -1 {
+		t.Errorf("expect -1, get %v", n)
+	}
+	if n, _ := h.Ttl(c, []byte("none")); n != -2 {
+		t.Errorf("expect -2, get %v", n)
+	}
+	if n, _ := h.Expire(c, []byte("k"), 100); n != 1 {
+		t.Errorf("expect 1, get %v", n)
+	}
+	if n, _ := h.Ttl(c, []byte("k")); n != 100 {
+		t.Errorf("expect 100, get %v", n)
+	}
+	if n, _ := h.Persist(c, []byte("k")); n != 1 {
+		t.Errorf("expect 1, get %v", n)
+	}
+	if n, _ := h.Pttl(c, []byte("k")); n != -1 {
+		t.Errorf("expect -1, get %v", n)
+	}
+
+	h.Psetex(c, []byte("k"), 1, []byte("v"))
+	h.Rpush(c, []byte("list"), []byte("a"), []byte("b"))
+	h.Pexpire(c, []byte("list"), 1)
+	time.Sleep(time.Millisecond * 5)
+
+	// lazy expire on read
+	if v, err := h.Get(c, []byte("k")); v != nil || err != nil {
+		t.Errorf("expect expired, get %s, %v", v, err)
+	}
+	if n, _ := h.Ttl(c, []byte("k")); n != -2 {
+		t.Errorf("expect -2, get %v", n)
+	}
+
+	// the sweeper deletes the list, with all its data keys
+	if n, err := sweepExpired(c, 100); n != 2 || err != nil {
+		t.Errorf("expect 2 index entries swept, get %v, %v", n, err)
+	}
+	for _, prefix := range []byte{kMetaKeyPrefix, kListDataKeyPrefix} {
+		if ks, _, _ := scanRecords(c, []byte{prefix}, false, nil, nil); len(ks) != 0 {
+			t.Errorf("expect nothing left under %c, get %q", prefix, ks)
+		}
+	}
+}
+
+func TestType(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+
+	h.Rpush(c, []byte("k"), []byte("a"), []byte("b"))
+	if r, _ := h.Type(c, []byte("k")); r.(StatusReply).code != "list" {
+		t.Errorf("expect list, get %v", r)
+	}
+	if r, _ := h.Type(c, []byte("none")); r.(StatusReply).code != "none" {
+		t.Errorf("expect none, get %v", r)
+	}
+	if _, err := h.Sadd(c, []byte("k"), []byte("a")); err != ErrWrongType {
+		t.Errorf("expect WRONGTYPE, get %v", err)
+	}
+	if _, err := h.Get(c, []byte("k")); err != ErrWrongType {
+		t.Errorf("expect WRONGTYPE, get %v", err)
+	}
+
+	// SET replaces the list, with all its data keys
+	h.Set(c, []byte("k"), []byte("v"))
+	if r, _ := h.Type(c, []byte("k")); r.(StatusReply).code != "string" {
+		t.Errorf("expect string, get %v", r)
+	}
+	if ks, _, _ := scanRecords(c, []byte{kListDataKeyPrefix}, false, nil, nil); len(ks) != 0 {
+		t.Errorf("expect list data deleted, get %q", ks)
+	}
+
+	h.Del(c, []byte("k"))
+	if r, _ := h.Type(c, []byte("k")); r.(StatusReply).code != "none" {
+		t.Errorf("expect none, get %v", r)
+	}
+}
+
+func TestDelExistsUnlink(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+
+	h.Set(c, []byte("a"), []byte("v"))
+	h.Hset(c, []byte("b"), []byte("f"), []byte("v"))
+	if n, _ := h.Exists(c, []byte("a"), []byte("b"), []byte("a"), []byte("none")); n != 3 {
+		t.Errorf("expect 3, get %v", n)
+	}
+	if n, _ := h.Del(c, []byte("a"), []byte("b"), []byte("a")); n != 2 {
+		t.Errorf("expect 2 deleted, get %v", n)
+	}
+
+	values := make([][]byte, unlinkSyncMax*3)
+	for i := range values {
+		values[i] = []byte("v")
+	}
+	h.Rpush(c, []byte("list"), values...)
+	if n, _ := h.Unlink(c, []byte("list"), []byte("none")); n != 1 {
+		t.Errorf("expect 1 unlinked, get %v", n)
+	}
+	// waits for the background delete, then starts from scratch
+	if n, _ := h.Rpush(c, []byte("list"), []byte("new")); n != 1 {
+		t.Errorf("expect a new list, get %v", n)
+	}
+	if ks, _, _ := scanRecords(c, []byte{kListDataKeyPrefix}, false, nil, nil); len(ks) != 0 {
+		t.Errorf("expect no data key left, the new list is inline, get %v keys", len(ks))
+	}
+
+	// what shutdown waits for
+	h.Rpush(c, []byte("list"), values...)
+	h.Unlink(c, []byte("list"))
+	unlinking.drain()
+	if ks, _, _ := scanRecords(c, []byte{kListDataKeyPrefix}, false, nil, nil); len(ks) != 0 {
+		t.Errorf("expect every data key deleted, get %v keys", len(ks))
+	}
+}
+
+func TestScanKeys(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+
+	for i := 0; i < 25; i++ {
+		h.Set(c, []byte(fmt.Sprintf("user:%02d", i)), []byte("v"))
+	}
+	h.Rpush(c, []byte("user:list"), []byte("a"), []byte("b"))
+	h.Sadd(c, []byte("other"), []byte("a"))
+	h.Psetex(c, []byte("user:gone"), 1, []byte("v"))
+	time.Sleep(time.Millisecond * 5)
+
+	if keys, _ := h.Keys(c, []byte("user:*")); len(keys) != 26 {
+		t.Errorf("expect 26 keys, get %q", keys)
+	}
+	if keys, _ := h.Keys(c, []byte("user:1?")); len(keys) != 10 {
+		t.Errorf("expect 10 keys, get %q", keys)
+	}
+
+	// a full iteration returns every key once, never list data keys. The
+	// expired key is still looked at, 28 records take 4 full pages and an empty one
+	seen := make(map[string]int)
+	cursor, calls := []byte("0"), 0
+	for {
+		next, keys, err := scanKeys(c, cursor, scanOptions{count: 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range keys {
+			seen[string(k)] += 1
+		}
+		calls += 1
+		if cursor = next; string(cursor) == "0" {
+			break
+		}
+	}
+	if len(seen) != 27 || calls != 5 {
+		t.Errorf("expect 27 keys in 5 calls, get %v in %d", seen, calls)
+	}
+	for k, n := range seen {
+		if n != 1 {
+			t.Errorf("%s returned %d times", k, n)
+		}
+	}
+
+	_, keys, _ := scanKeys(c, []byte("0"), scanOptions{count: 100, typ: "list"})
+	if len(keys) != 1 || string(keys[0]) != "user:list" {
+		t.Errorf("expect user:list, get %q", keys)
+	}
+	if _, err := h.Scan(c, []byte("12345")); err != ErrInvalidCursor {
+		t.Errorf("expect invalid cursor, get %v", err)
+	}
+	if _, err := h.Scan(c, []byte("0"), []byte("COUNT")); err != ErrSyntax {
+		t.Errorf("expect syntax error, get %v", err)
+	}
+
+	// the cursor of a long key still fits an unsigned 64 bit integer
+	h.Set(c, bytes.Repeat([]byte("z"), 100), []byte("v"))
+	for cursor := []byte("0"); ; {
+		next, _, err := scanKeys(c, cursor, scanOptions{count: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := strconv.ParseUint(string(next), 10, 64); err != nil {
+			t.Fatalf("expect an unsigned 64 bit cursor, get %s", next)
+		}
+		if cursor = next; string(cursor) == "0" {
+			break
+		}
+	}
+
+	// the cursor of a short key is good on any connection, the one of a long
+	// key on its own, whatever other connections scan meanwhile
+	h.Set(c, []byte("a"), []byte("v"))
+	other := NewReisClient(&MockConn{})
+	other.db = c.db
+	short, _, _ := scanKeys(c, []byte("0"), scanOptions{count: 1})
+	long, _, _ := scanKeys(c, short, scanOptions{count: 2}) // other, user:00
+	for i := 0; i < kClientCursorMax*2; i++ {
+		if _, _, err := scanKeys(other, short, scanOptions{count: 2}); err != nil {
+			t.Fatalf("expect the short cursor good on another connection, get %v", err)
+		}
+	}
+	if len(other.cursors) != kClientCursorMax {
+		t.Errorf("expect %d cursors kept, get %d", kClientCursorMax, len(other.cursors))
+	}
+	if _, keys, err := scanKeys(c, long, scanOptions{count: 1}); err != nil || string(keys[0]) != "user:01" {
+		t.Errorf("expect user:01 after the long cursor, get %q, %v", keys, err)
+	}
+}
+
+// run a [HSZ]SCAN to the end, return everything it replied
+func scanAll(t *testing.T, scan func(cursor []byte) (Reply, error)) [][]byte {
+	var all [][]byte
+	cursor := []byte("0")
+	for {
+		r, err := scan(cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replies := r.(ArrayReply).replies
+		all = append(all, replies[1].(MultiBulkReply).values...)
+		cursor = replies[0].(BulkReply).value
+		if _, err := strconv.ParseUint(string(cursor), 10, 64); err != nil {
+			t.Fatalf("expect an unsigned 64 bit cursor, get %s", cursor)
+		}
+		if string(cursor) == "0" {
+			return all
+		}
+	}
+}
+
+func TestScanCollections(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+
+	for i := 0; i < 30; i++ {
+		m := []byte(fmt.Sprintf("m%02d", i))
+		h.Hset(c, []byte("h"), m, []byte("v"))
+		h.Sadd(c, []byte("s"), m)
+		h.Zadd(c, []byte("z"), []byte(strconv.Itoa(i)), m)
+	}
+	h.Sadd(c, []byte("s2"), []byte("other"))
+
+	count := []byte("4")
+	if all := scanAll(t, func(cursor []byte) (Reply, error) {
+		return h.Sscan(c, []byte("s"), cursor, []byte("COUNT"), count)
+	}); len(all) != 30 || string(all[29]) != "m29" {
+		t.Errorf("expect 30 members, get %q", all)
+	}
+	if all := scanAll(t, func(cursor []byte) (Reply, error) {
+		return h.Hscan(c, []byte("h"), cursor, []byte("MATCH"), []byte("m1*"), []byte("COUNT"), count)
+	}); len(all) != 20 || string(all[0]) != "m10" || string(all[1]) != "v" {
+		t.Errorf("expect 10 fields and values, get %q", all)
+	}
+	if all := scanAll(t, func(cursor []byte) (Reply, error) {
+		return h.Zscan(c, []byte("z"), cursor, []byte("MATCH"), []byte("m0[0-2]"))
+	}); len(all) != 6 || string(all[4]) != "m02" || string(all[5]) != "2" {
+		t.Errorf("expect 3 members and scores, get %q", all)
+	}
+	for i := 0; i < 3; i++ { // members too long for a cursor of their own
+		h.Hset(c, []byte("long"), bytes.Repeat([]byte{'a' + byte(i)}, 100), []byte("v"))
+	}
+	if all := scanAll(t, func(cursor []byte) (Reply, error) {
+		return h.Hscan(c, []byte("long"), cursor, []byte("COUNT"), []byte("1"))
+	}); len(all) != 6 {
+		t.Errorf("expect 3 fields and values, get %q", all)
+	}
+
+	// a cursor of a short member is good on any connection, the one of a long
+	// member on its own, however many scans other connections leave unfinished
+	other := NewReisClient(&MockConn{})
+	other.db = c.db
+	r, _ := h.Sscan(c, []byte("s"), []byte("0"), []byte("COUNT"), count)
+	if r, err := h.Sscan(other, []byte("s"), r.(ArrayReply).replies[0].(BulkReply).value, []byte("COUNT"), count); err != nil ||
+		string(r.(ArrayReply).replies[1].(MultiBulkReply).values[0]) != "m04" {
+		t.Errorf("expect m04 on another connection, get %v, %v", r, err)
+	}
+	r, _ = h.Hscan(c, []byte("long"), []byte("0"), []byte("COUNT"), []byte("1"))
+	long := r.(ArrayReply).replies[0].(BulkReply).value
+	for i := 0; i < kClientCursorMax*2; i++ {
+		h.Hscan(other, []byte("long"), []byte("0"), []byte("COUNT"), []byte("1"))
+	}
+	if r, err := h.Hscan(c, []byte("long"), long, []byte("COUNT"), []byte("1")); err != nil ||
+		r.(ArrayReply).replies[1].(MultiBulkReply).values[0][0] != 'b' {
+		t.Errorf("expect the second field, get %v, %v", r, err)
+	}
+	if all := scanAll(t, func(cursor []byte) (Reply, error) {
+		return h.Sscan(c, []byte("none"), cursor)
+	}); len(all) != 0 {
+		t.Errorf("expect nothing, get %q", all)
+	}
+
+	// a cursor is only good for the collection that returned it
+	r, _ = h.Sscan(c, []byte("s"), []byte("0"), []byte("COUNT"), count)
+	cursor := r.(ArrayReply).replies[0].(BulkReply).value
+	if _, err := h.Sscan(c, []byte("s2"), cursor); err != ErrInvalidCursor {
+		t.Errorf("expect invalid cursor, get %v", err)
+	}
+	if _, err := h.Hscan(c, []byte("s"), []byte("0")); err != ErrWrongType {
+		t.Errorf("expect wrong type, get %v", err)
+	}
+	if _, err := h.Sscan(c, []byte("s"), []byte("0"), []byte("TYPE"), []byte("set")); err != ErrSyntax {
+		t.Errorf("expect syntax error, get %v", err)
+	}
+}
@@ -1,16 +1,15 @@
 package main
 
-func listMetaKey(a *Arena, key []byte) []byte {
-	mKey := a.Allocate(len(key) + 1)
-	mKey[0] = kListKeyPrefix
-	copy(mKey[1:], key)
-	return mKey
-}
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
 
 func (h *DbHandler) Llen(c *redisClient, key []byte) (int, error) {
-	metaKey := listMetaKey(c.arena, key)
-	if old, err := c.db.Get(c.arena, metaKey); err != nil || old == nil {
-		return 0, nil
+	metaKey := encodeMetaKey(c.arena, key)
+	if old, err := getMeta(c, metaKey, kTypeList); err != nil || old == nil {
+		return 0, err
 	} else {
 		li := LinkedList(old)
 		llen, _ := li.listMeta()
@@ -18,74 +17,132 @@ func (h *DbHandler) Llen(c *redisClient, key []byte) (int, error) {
 	}
 }
 
-func (h *DbHandler) Rpush(c *redisClient, key []byte, values ...[]byte) (int, error) {
-	metaKey := listMetaKey(c.arena, key)
-	if old, err := c.db.Get(c.arena, metaKey); err != nil {
-		return 0, err
-	} else if old == nil { // new value
-		ks, vs := NewLinkedList(c.arena, metaKey, values)
-		return len(values), c.db.Batch(ks, vs)
+// The records to save values as the list at mKey: inline if it is small
+// enough, otherwise as a LinkedList. old is nil for a new list, or an inline
+// list, whose expire-at is kept. The meta comes first, nil if values is empty
+func (h *DbHandler) listRecords(c *redisClient, mKey []byte, old LinkedList, values [][]byte) (ks, vs [][]byte) {
+	inline, maxValue := len(values) <= h.maxCompactEntries(kTypeList), h.maxCompactValue(kTypeList)
+	for i := 0; i < len(values) && inline; i++ {
+		inline = len(values[i]) <= maxValue
+	}
+	if len(values) == 0 { // the list is gone
+		ks, vs = createKvs(1)
+		ks[0] = mKey
+	} else if inline {
+		ks, vs = createKvs(1)
+		ks[0], vs[0] = mKey, []byte(NewInlineList(c.arena, old, values))
 	} else {
-		li := LinkedList(old)
-		llen, _ := li.listMeta()
-		ks, vs := li.Rpush(c.arena, metaKey, values)
-		return llen + len(values), c.db.Batch(ks, vs)
+		ks, vs = NewLinkedList(c.arena, mKey, values)
+		if old != nil {
+			setMetaExpireAt(vs[0], metaExpireAt(old))
+		}
 	}
+	return
 }
 
-func (h *DbHandler) Lpush(c *redisClient, key []byte, values ...[]byte) (int, error) {
-	metaKey := listMetaKey(c.arena, key)
-	if old, err := c.db.Get(c.arena, metaKey); err != nil {
-		return 0, err
-	} else if old == nil { // new value
-		ks, vs := NewLinkedList(c.arena, metaKey, values)
-		return len(values), c.db.Batch(ks, vs)
+// the records to push values one by one to the head or the tail of li, nil for a new list
+func (h *DbHandler) pushRecords(c *redisClient, mKey []byte, li LinkedList, values [][]byte, left bool) (ks, vs [][]byte) {
+	if li != nil && !li.inline() {
+		if left {
+			return li.Lpush(c.arena, mKey, values)
+		}
+		return li.Rpush(c.arena, mKey, values)
+	}
+	var old [][]byte
+	if li != nil {
+		old = li.inlineValues()
+	}
+	all := make([][]byte, 0, len(old)+len(values))
+	if left {
+		for i := len(values) - 1; i >= 0; i-- {
+			all = append(all, values[i])
+		}
+		all = append(all, old...)
 	} else {
-		li := LinkedList(old)
-		llen, _ := li.listMeta()
-		ks, vs := li.Lpush(c.arena, metaKey, values)
-		return llen + len(values), c.db.Batch(ks, vs)
+		all = append(append(all, old...), values...)
 	}
+	return h.listRecords(c, mKey, li, all)
 }
 
-func (h *DbHandler) Lpop(c *redisClient, key []byte) ([]byte, error) {
-	metaKey := listMetaKey(c.arena, key)
-	if old, err := c.db.Get(c.arena, metaKey); err != nil || old == nil {
-		return nil, err
-	} else {
-		li := LinkedList(old)
-		_, minSeq := li.listMeta()
-		if val, err := c.db.Get(c.arena, listDataKey(c.arena, metaKey, minSeq)); err != nil {
-			return nil, err
+// the head or the tail element of li, and the records to pop it. vs[0] is
+// the meta after the pop, nil if the list is gone
+func (h *DbHandler) popRecords(c *redisClient, mKey []byte, li LinkedList, left bool) (value []byte, ks, vs [][]byte, err error) {
+	llen, minseq := li.listMeta()
+	if li.inline() {
+		values := li.inlineValues()
+		if left {
+			value, values = values[0], values[1:]
 		} else {
-			ks, vs := li.Pop(c.arena, metaKey, 1, 0)
-			return val, c.db.Batch(ks, vs)
+			value, values = values[llen-1], values[:llen-1]
 		}
+		ks, vs = h.listRecords(c, mKey, li, values)
+		return value, ks, vs, nil
+	}
+
+	seq, l, r := minseq, 1, 0
+	if !left {
+		seq, l, r = minseq+llen-1, 0, 1
+	}
+	if value, err = c.db.Get(c.arena, listDataKey(c.arena, mKey, seq)); err != nil {
+		return nil, nil, nil, err
 	}
+	ks, vs = li.Pop(c.arena, mKey, l, r)
+	return value, ks, vs, nil
 }
 
-func (h *DbHandler) Rpop(c *redisClient, key []byte) ([]byte, error) {
-	metaKey := listMetaKey(c.arena, key)
-	if old, err := c.db.Get(c.arena, metaKey); err != nil || old == nil {
-		return nil, err
+func (h *DbHandler) push(c *redisClient, key []byte, values [][]byte, left bool) (int, error) {
+	defer locks.lock(c, key)()
+	defer h.notifyPush(c, key, len(values))
+	metaKey := encodeMetaKey(c.arena, key)
+	old, err := getMeta(c, metaKey, kTypeList)
+	if err != nil {
+		return 0, err
+	}
+	llen := 0
+	if old != nil {
+		llen, _ = LinkedList(old).listMeta()
+	}
+	ks, vs := h.pushRecords(c, metaKey, LinkedList(old), values, left)
+	return llen + len(values), c.db.Batch(ks, vs)
+}
+
+func (h *DbHandler) Rpush(c *redisClient, key []byte, values ...[]byte) (int, error) {
+	return h.push(c, key, values, false)
+}
+
+func (h *DbHandler) Lpush(c *redisClient, key []byte, values ...[]byte) (int, error) {
+	return h.push(c, key, values, true)
+}
+
+// the head or the tail element, ok is false if the list is empty
+func (h *DbHandler) pop(c *redisClient, key []byte, left bool) (value []byte, ok bool, err error) {
+	defer locks.lock(c, key)()
+	metaKey := encodeMetaKey(c.arena, key)
+	if old, err := getMeta(c, metaKey, kTypeList); err != nil || old == nil {
+		return nil, false, err
+	} else if val, ks, vs, err := h.popRecords(c, metaKey, LinkedList(old), left); err != nil {
+		return nil, false, err
 	} else {
-		li := LinkedList(old)
-		llen, minSeq := li.listMeta()
-		if val, err := c.db.Get(c.arena, listDataKey(c.arena, metaKey, minSeq+llen-1)); err != nil {
-			return nil, err
-		} else {
-			ks, vs := li.Pop(c.arena, metaKey, 0, 1)
-			return val, c.db.Batch(ks, vs)
-		}
+		return val, true, c.db.Batch(ks, vs)
 	}
 }
 
+func (h *DbHandler) Lpop(c *redisClient, key []byte) ([]byte, error) {
+	v, _, err := h.pop(c, key, true)
+	return v, err
+}
+
+func (h *DbHandler) Rpop(c *redisClient, key []byte) ([]byte, error) {
+	v, _, err := h.pop(c, key, false)
+	return v, err
+}
+
 func (h *DbHandler) Lrange(c *redisClient, key []byte, start, end int) ([][]byte, error) {
-	metaKey := listMetaKey(c.arena, key)
-	if old, err := c.db.Get(c.arena, metaKey); err != nil || old == nil {
+	metaKey := encodeMetaKey(c.arena, key)
+	if old, err := getMeta(c, metaKey, kTypeList); err != nil || old == nil {
 		return nil, err
 	} else {
-		llen, seqstart := LinkedList(old).listMeta()
+		llen, _ := LinkedList(old).listMeta()
 		// [start, end]
 		if start < 0 {
 			start += llen
@@ -106,32 +163,14 @@ func (h *DbHandler) Lrange(c *redisClient, key []byte, start, end int) ([][]byte
 		if end >= llen {
 			end = llen - 1
 		}
-		count := end - start + 1
-
-		startKey := listDataKey(c.arena, metaKey, start+seqstart)
-		result := make([][]byte, 0, count)
-
-		n := 0
-		collector := func(k, v []byte) bool {
-			result = append(result, v)
-			n += 1
-			if n >= count {
-				return false
-			} else {
-				return true
-			}
-		}
-
-		if err := c.db.Scan(c.arena, startKey, collector); err != nil {
-			return nil, err
-		}
-		return result, nil
+		return readList(c, metaKey, LinkedList(old), start, end-start+1)
 	}
 }
 
 func (h *DbHandler) Ltrim(c *redisClient, key []byte, start, end int) error {
-	metaKey := listMetaKey(c.arena, key)
-	if old, err := c.db.Get(c.arena, metaKey); err != nil || old == nil {
+	defer locks.lock(c, key)()
+	metaKey := encodeMetaKey(c.arena, key)
+	if old, err := getMeta(c, metaKey, kTypeList); err != nil || old == nil {
 		return err
 	} else {
 		li := LinkedList(old)
@@ -158,11 +197,340 @@ func (h *DbHandler) Ltrim(c *redisClient, key []byte, start, end int) error {
 			ltrim, rtrim = start, llen-end-1
 		}
 
-		ks, vs := li.Pop(c.arena, metaKey, ltrim, rtrim)
-		if len(ks) > 0 {
-			return c.db.Batch(ks, vs)
+		var ks, vs [][]byte
+		if li.inline() {
+			ks, vs = h.listRecords(c, metaKey, li, li.inlineValues()[ltrim:llen-rtrim])
 		} else {
-			return nil
+			ks, vs = li.Pop(c.arena, metaKey, ltrim, rtrim)
+		}
+		return c.db.Batch(ks, vs)
+	}
+}
+
+// normalize a negative index, ok is false if it's out of [0, llen)
+func listIndex(index, llen int) (int, bool) {
+	if index < 0 {
+		index += llen
+	}
+	return index, index >= 0 && index < llen
+}
+
+// n elements of the list from index start on
+func readList(c *redisClient, mKey []byte, li LinkedList, start, n int) ([][]byte, error) {
+	if li.inline() {
+		return li.inlineValues()[start : start+n], nil
+	}
+	values := make([][]byte, 0, n)
+	if n == 0 {
+		return values, nil
+	}
+	_, minseq := li.listMeta()
+	err := c.db.ScanRange(c.arena, listDataKey(c.arena, mKey, minseq+start),
+		listDataKey(c.arena, mKey, minseq+start+n), false, func(k, v []byte) bool {
+			values = append(values, v)
+			return true
+		})
+	return values, err
+}
+
+// call fn with the elements from the head, or from the tail if reverse, until it returns false
+func scanList(c *redisClient, mKey []byte, li LinkedList, reverse bool, fn func(v []byte) bool) error {
+	llen, minseq := li.listMeta()
+	if li.inline() {
+		values := li.inlineValues()
+		for i := 0; i < llen; i++ {
+			if reverse && !fn(values[llen-1-i]) || !reverse && !fn(values[i]) {
+				break
+			}
+		}
+		return nil
+	}
+	return c.db.ScanRange(c.arena, listDataKey(c.arena, mKey, minseq),
+		listDataKey(c.arena, mKey, minseq+llen), reverse, func(k, v []byte) bool {
+			return fn(v)
+		})
+}
+
+// Replace the elements in [start, end) with values. Seqs stay contiguous: the
+// elements before start, or the ones from end on, whichever are fewer, are
+// moved to make room or close the gap. An inline list is simply saved again.
+func (h *DbHandler) spliceList(c *redisClient, mKey []byte, li LinkedList, start, end int, values [][]byte) error {
+	llen, minseq := li.listMeta()
+	delta := len(values) - (end - start)
+	size := llen + delta
+	if size == 0 {
+		return deleteKey(c, mKey, li)
+	} else if li.inline() {
+		old := li.inlineValues()
+		spliced := make([][]byte, 0, size)
+		spliced = append(append(append(spliced, old[:start]...), values...), old[end:]...)
+		ks, vs := h.listRecords(c, mKey, li, spliced)
+		return c.db.Batch(ks, vs)
+	}
+
+	var ks, vs [][]byte
+	if start <= llen-end { // move the head
+		head, err := readList(c, mKey, li, 0, start)
+		if err != nil {
+			return err
+		}
+		newseq := minseq - delta
+		for seq := minseq; seq < newseq; seq++ { // shrunk, free the seqs left behind
+			ks, vs = append(ks, listDataKey(c.arena, mKey, seq)), append(vs, nil)
+		}
+		for i, v := range append(head, values...) {
+			ks, vs = append(ks, listDataKey(c.arena, mKey, newseq+i)), append(vs, v)
+		}
+		minseq = newseq
+	} else { // move the tail
+		tail, err := readList(c, mKey, li, end, llen-end)
+		if err != nil {
+			return err
+		}
+		for seq := minseq + size; seq < minseq+llen; seq++ {
+			ks, vs = append(ks, listDataKey(c.arena, mKey, seq)), append(vs, nil)
+		}
+		for i, v := range append(values, tail...) {
+			ks, vs = append(ks, listDataKey(c.arena, mKey, minseq+start+i)), append(vs, v)
+		}
+	}
+	li.setListMeta(size, minseq)
+	return c.db.Batch(append(ks, mKey), append(vs, []byte(li)))
+}
+
+func (h *DbHandler) Lindex(c *redisClient, key []byte, index int) ([]byte, error) {
+	mKey := encodeMetaKey(c.arena, key)
+	if old, err := getMeta(c, mKey, kTypeList); err != nil || old == nil {
+		return nil, err
+	} else {
+		li := LinkedList(old)
+		llen, minseq := li.listMeta()
+		index, ok := listIndex(index, llen)
+		if !ok {
+			return nil, nil
+		} else if li.inline() {
+			return li.inlineValues()[index], nil
+		}
+		return c.db.Get(c.arena, listDataKey(c.arena, mKey, minseq+index))
+	}
+}
+
+func (h *DbHandler) Lset(c *redisClient, key []byte, index int, value []byte) error {
+	defer locks.lock(c, key)()
+	mKey := encodeMetaKey(c.arena, key)
+	if old, err := getMeta(c, mKey, kTypeList); err != nil {
+		return err
+	} else if old == nil {
+		return ErrNoSuchKey
+	} else {
+		li := LinkedList(old)
+		llen, minseq := li.listMeta()
+		index, ok := listIndex(index, llen)
+		if !ok {
+			return ErrIndexOutOfRange
+		} else if li.inline() {
+			return h.spliceList(c, mKey, li, index, index+1, [][]byte{value})
+		}
+		return c.db.Set(listDataKey(c.arena, mKey, minseq+index), value)
+	}
+}
+
+// LINSERT key BEFORE|AFTER pivot element, -1 if pivot is not found
+func (h *DbHandler) Linsert(c *redisClient, key, where, pivot, value []byte) (int, error) {
+	after := false
+	switch strings.ToUpper(string(where)) {
+	case "BEFORE":
+	case "AFTER":
+		after = true
+	default:
+		return 0, ErrSyntax
+	}
+	defer locks.lock(c, key)()
+	mKey := encodeMetaKey(c.arena, key)
+	old, err := getMeta(c, mKey, kTypeList)
+	if err != nil || old == nil {
+		return 0, err
+	}
+
+	li := LinkedList(old)
+	llen, _ := li.listMeta()
+	pos, found := -1, false
+	err = scanList(c, mKey, li, false, func(v []byte) bool {
+		pos, found = pos+1, bytes.Equal(v, pivot)
+		return !found
+	})
+	if err != nil {
+		return 0, err
+	} else if !found {
+		return -1, nil
+	}
+	if after {
+		pos += 1
+	}
+	return llen + 1, h.spliceList(c, mKey, li, pos, pos, [][]byte{value})
+}
+
+// LREM key count element: the first count from the head, the last -count
+// from the tail, or all of them if count is 0
+func (h *DbHandler) Lrem(c *redisClient, key []byte, count int, value []byte) (int, error) {
+	defer locks.lock(c, key)()
+	mKey := encodeMetaKey(c.arena, key)
+	old, err := getMeta(c, mKey, kTypeList)
+	if err != nil || old == nil {
+		return 0, err
+	}
+
+	li := LinkedList(old)
+	llen, _ := li.listMeta()
+	values, err := readList(c, mKey, li, 0, llen)
+	if err != nil {
+		return 0, err
+	}
+	remove := make([]bool, llen)
+	removed, first, last := 0, llen, -1
+	for i := 0; i < llen && (count == 0 || removed < abs(count)); i++ {
+		j := i
+		if count < 0 {
+			j = llen - 1 - i
+		}
+		if bytes.Equal(values[j], value) {
+			remove[j], removed = true, removed+1
+			if j < first {
+				first = j
+			}
+			if j > last {
+				last = j
+			}
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	kept := make([][]byte, 0, last-first+1-removed)
+	for i := first; i <= last; i++ {
+		if !remove[i] {
+			kept = append(kept, values[i])
+		}
+	}
+	return removed, h.spliceList(c, mKey, li, first, last+1, kept)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// push only if the list exists
+func (h *DbHandler) pushx(c *redisClient, key []byte, values [][]byte, left bool) (int, error) {
+	defer locks.lock(c, key)()
+	if old, err := getMeta(c, encodeMetaKey(c.arena, key), kTypeList); err != nil || old == nil {
+		return 0, err
+	}
+	if left {
+		return h.Lpush(c, key, values...)
+	}
+	return h.Rpush(c, key, values...)
+}
+
+func (h *DbHandler) Lpushx(c *redisClient, key []byte, values ...[]byte) (int, error) {
+	return h.pushx(c, key, values, true)
+}
+
+func (h *DbHandler) Rpushx(c *redisClient, key []byte, values ...[]byte) (int, error) {
+	return h.pushx(c, key, values, false)
+}
+
+func (h *DbHandler) Rpoplpush(c *redisClient, src, dst []byte) ([]byte, error) {
+	v, _, err := h.popPush(c, src, dst, false, true)
+	return v, err
+}
+
+func parseListSide(b []byte) (left bool, err error) {
+	switch strings.ToUpper(string(b)) {
+	case "LEFT":
+		return true, nil
+	case "RIGHT":
+		return false, nil
+	}
+	return false, ErrSyntax
+}
+
+// LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+func (h *DbHandler) Lmove(c *redisClient, src, dst, from, to []byte) ([]byte, error) {
+	fromLeft, err := parseListSide(from)
+	if err != nil {
+		return nil, err
+	}
+	toLeft, err := parseListSide(to)
+	if err != nil {
+		return nil, err
+	}
+	v, _, err := h.popPush(c, src, dst, fromLeft, toLeft)
+	return v, err
+}
+
+// LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+func (h *DbHandler) Lpos(c *redisClient, key, value []byte, args ...[]byte) (Reply, error) {
+	rank, count, maxlen, withCount := 1, 1, 0, false
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, ErrSyntax
+		}
+		n, err := strconv.Atoi(string(args[i+1]))
+		if err != nil {
+			return nil, ErrExpectInteger
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "RANK":
+			if rank = n; n == 0 {
+				return nil, ErrRankZero
+			}
+		case "COUNT":
+			if count, withCount = n, true; n < 0 {
+				return nil, ErrExpectPositivInteger
+			}
+		case "MAXLEN":
+			if maxlen = n; n < 0 {
+				return nil, ErrExpectPositivInteger
+			}
+		default:
+			return nil, ErrSyntax
 		}
 	}
+
+	mKey := encodeMetaKey(c.arena, key)
+	positions := make([]Reply, 0)
+	if old, err := getMeta(c, mKey, kTypeList); err != nil {
+		return nil, err
+	} else if old != nil {
+		li := LinkedList(old)
+		llen, _ := li.listMeta()
+		reverse, skip := rank < 0, abs(rank)-1
+		i := 0
+		err = scanList(c, mKey, li, reverse, func(v []byte) bool {
+			if bytes.Equal(v, value) {
+				if skip > 0 {
+					skip -= 1
+				} else if reverse {
+					positions = append(positions, IntReply{llen - 1 - i})
+				} else {
+					positions = append(positions, IntReply{i})
+				}
+			}
+			i += 1
+			return (count == 0 || len(positions) < count) && (maxlen == 0 || i < maxlen)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if withCount {
+		return ArrayReply{positions}, nil
+	} else if len(positions) == 0 {
+		return BulkReply{nil}, nil
+	}
+	return positions[0], nil
 }
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// clients pushing to and popping from the same list, no update is lost
+func TestListConcurrentPush(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+
+	const clients, pushes = 16, 200
+	key := []byte("list")
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cc := NewReisClient(&MockConn{})
+			cc.db = c.db
+			for j := 0; j < pushes; j++ {
+				v := []byte(strconv.Itoa(i*pushes + j))
+				var err error
+				if j%2 == 0 {
+					_, err = h.Rpush(cc, key, v)
+				} else {
+					_, err = h.Lpush(cc, key, v)
+				}
+				if err != nil {
+					t.Error(err)
+				}
+				cc.arena.Reset()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n, _ := h.Llen(c, key); n != clients*pushes {
+		t.Errorf("expect %d, get %d", clients*pushes, n)
+	}
+	seen := make(map[string]bool)
+	values, _ := h.Lrange(c, key, 0, -1)
+	for _, v := range values {
+		seen[string(v)] = true
+	}
+	if len(seen) != clients*pushes {
+		t.Errorf("expect %d distinct elements, get %d", clients*pushes, len(seen))
+	}
+
+	// pop them all concurrently, every element comes out once
+	var mu sync.Mutex
+	popped := make(map[string]bool)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cc := NewReisClient(&MockConn{})
+			cc.db = c.db
+			for {
+				pop := h.Lpop
+				if i%2 == 0 {
+					pop = h.Rpop
+				}
+				v, err := pop(cc, key)
+				if err != nil {
+					t.Error(err)
+				}
+				if v == nil {
+					return
+				}
+				mu.Lock()
+				if popped[string(v)] {
+					t.Errorf("%s popped twice", v)
+				}
+				popped[string(v)] = true
+				mu.Unlock()
+				cc.arena.Reset()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(popped) != clients*pushes {
+		t.Errorf("expect %d popped, get %d", clients*pushes, len(popped))
+	}
+}
+
+// the same commands on inline lists, and on lists saved as LinkedList
+func TestListCommands(t *testing.T) {
+	for _, max := range []int{kMaxCompactEntries, 1} {
+		testListCommands(t, max)
+	}
+}
+
+func testListCommands(t *testing.T, maxInline int) {
+	h, c, done := newTestClient(t)
+	defer done()
+	h.server = &Server{conf: &RockRedisConf{ListMaxZiplistEntries: maxInline}, blocked: newBlockedClients()}
+
+	key := []byte("l")
+	// the elements, and no data key left behind
+	check := func(expect string) {
+		values, _ := h.Lrange(c, key, 0, -1)
+		got := string(bytes.Join(values, []byte(" ")))
+		if got != expect {
+			t.Errorf("%d: expect %q, get %q", maxInline, expect, got)
+		}
+		dataKeys := len(values)
+		if meta, _ := c.db.Get(c.arena, encodeMetaKey(c.arena, key)); LinkedList(meta).inline() {
+			dataKeys = 0
+		}
+		if ks, _, _ := scanRecords(c, []byte{kListDataKeyPrefix}, false, nil, nil); len(ks) != dataKeys {
+			t.Errorf("%d: expect %d data keys, get %d", maxInline, dataKeys, len(ks))
+		}
+	}
+	args := func(s string) [][]byte {
+		return bytes.Fields([]byte(s))
+	}
+
+	if n, _ := h.Rpushx(c, key, []byte("a")); n != 0 {
+		t.Errorf("expect 0, get %v", n)
+	}
+	h.Rpush(c, key, args("a b c d e f")...)
+	if v, _ := h.Lindex(c, key, -2); string(v) != "e" {
+		t.Errorf("expect e, get %s", v)
+	}
+	if v, _ := h.Lindex(c, key, 6); v != nil {
+		t.Errorf("expect nil, get %s", v)
+	}
+	h.Lset(c, key, 1, []byte("B"))
+	if err := h.Lset(c, key, 10, []byte("x")); err != ErrIndexOutOfRange {
+		t.Errorf("expect out of range, get %v", err)
+	}
+	if err := h.Lset(c, []byte("none"), 0, []byte("x")); err != ErrNoSuchKey {
+		t.Errorf("expect no such key, get %v", err)
+	}
+	check("a B c d e f")
+
+	h.Linsert(c, key, []byte("BEFORE"), []byte("B"), []byte("x")) // the head moves
+	h.Linsert(c, key, []byte("after"), []byte("e"), []byte("y"))  // the tail moves
+	check("a x B c d e y f")
+	if n, _ := h.Linsert(c, key, []byte("AFTER"), []byte("none"), []byte("z")); n != -1 {
+		t.Errorf("expect -1, get %v", n)
+	}
+
+	h.Rpush(c, key, args("a x a")...)
+	check("a x B c d e y f a x a")
+	if n, _ := h.Lrem(c, key, -2, []byte("a")); n != 2 {
+		t.Errorf("expect 2 removed, get %v", n)
+	}
+	check("a x B c d e y f x")
+	if n, _ := h.Lrem(c, key, 0, []byte("x")); n != 2 {
+		t.Errorf("expect 2 removed, get %v", n)
+	}
+	check("a B c d e y f")
+	h.Lrem(c, key, 1, []byte("a"))
+	check("B c d e y f")
+
+	if n, _ := h.Lpushx(c, key, []byte("y")); n != 7 {
+		t.Errorf("expect 7, get %v", n)
+	}
+	check("y B c d e y f")
+	if r, _ := h.Lpos(c, key, []byte("y")); r != (IntReply{0}) {
+		t.Errorf("expect 0, get %v", r)
+	}
+	if r, _ := h.Lpos(c, key, []byte("y"), args("RANK -1")...); r != (IntReply{5}) {
+		t.Errorf("expect 5, get %v", r)
+	}
+	if r, _ := h.Lpos(c, key, []byte("y"), args("COUNT 0")...); len(r.(ArrayReply).replies) != 2 {
+		t.Errorf("expect 2 positions, get %v", r)
+	}
+	if r, _ := h.Lpos(c, key, []byte("y"), args("RANK 2 MAXLEN 3")...); r.(BulkReply).value != nil {
+		t.Errorf("expect nil, get %v", r)
+	}
+
+	// rotate
+	if v, _ := h.Rpoplpush(c, key, key); string(v) != "f" {
+		t.Errorf("expect f, get %s", v)
+	}
+	check("f y B c d e y")
+	h.Lmove(c, key, []byte("dst"), []byte("LEFT"), []byte("RIGHT"))
+	h.Lmove(c, key, []byte("dst"), []byte("RIGHT"), []byte("LEFT"))
+	if r, _ := h.Lrange(c, []byte("dst"), 0, -1); string(bytes.Join(r, nil)) != "yf" {
+		t.Errorf("expect y f, get %q", r)
+	}
+	h.Del(c, []byte("dst"))
+	check("y B c d e")
+
+	h.Lrem(c, key, 0, []byte("y"))
+	h.Ltrim(c, key, 0, 0)
+	h.Lrem(c, key, 0, []byte("B"))
+	if n, _ := h.Exists(c, key); n != 0 {
+		t.Errorf("expect the empty list deleted, get %v", n)
+	}
+
+	// an empty element is not a missing one
+	empty := func(cmd string, v []byte, err error) {
+		if v == nil || len(v) != 0 || err != nil {
+			t.Errorf("%d: %s: expect an empty element, get %q, %v", maxInline, cmd, v, err)
+		}
+	}
+	key = []byte("e")
+	h.Rpush(c, key, []byte(""), []byte(""), []byte("x"), []byte(""))
+	v, err := h.Lindex(c, key, 0)
+	empty("lindex", v, err)
+	h.Lset(c, key, 2, []byte(""))
+	v, err = h.Lindex(c, key, 2)
+	empty("lset", v, err)
+	v, err = h.Lpop(c, key)
+	empty("lpop", v, err)
+	v, err = h.Rpop(c, key)
+	empty("rpop", v, err)
+	v, err = h.Rpoplpush(c, key, key)
+	empty("rpoplpush", v, err)
+	v, err = h.Lmove(c, key, []byte("dst"), []byte("LEFT"), []byte("RIGHT"))
+	empty("lmove", v, err)
+	if n, _ := h.Llen(c, key); n != 1 {
+		t.Errorf("%d: expect 1 element left, get %v", maxInline, n)
+	}
+	if r, _ := h.Lrange(c, []byte("dst"), 0, -1); len(r) != 1 || r[0] == nil || len(r[0]) != 0 {
+		t.Errorf("%d: expect an empty element moved, get %q", maxInline, r)
+	}
+}
+
+func TestInlineList(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+	h.server = &Server{conf: &RockRedisConf{ListMaxZiplistEntries: 3}, blocked: newBlockedClients()}
+
+	key := []byte("l")
+	inline := func() bool {
+		meta, _ := c.db.Get(c.arena, encodeMetaKey(c.arena, key))
+		return LinkedList(meta).inline()
+	}
+	h.Lpush(c, key, []byte("b"), []byte("a"))
+	h.Expire(c, key, 100)
+	if !inline() {
+		t.Error("expect a small list saved inline")
+	}
+	if v, _ := h.Lpop(c, key); string(v) != "a" {
+		t.Errorf("expect a, get %s", v)
+	}
+
+	h.Rpush(c, key, []byte("c"), []byte("d"), []byte("e")) // crosses the threshold
+	if inline() {
+		t.Error("expect a LinkedList")
+	}
+	if values, _ := h.Lrange(c, key, 0, -1); string(bytes.Join(values, nil)) != "bcde" {
+		t.Errorf("expect b c d e, get %q", values)
+	}
+	if ttl, _ := h.Ttl(c, key); ttl <= 0 {
+		t.Errorf("expect the ttl kept, get %v", ttl)
+	}
+
+	h.Rpush(c, []byte("big"), bytes.Repeat([]byte("v"), kMaxCompactValue+1))
+	if n, _ := h.Llen(c, []byte("big")); n != 1 {
+		t.Errorf("expect 1, get %v", n)
+	}
+	if ks, _, _ := scanRecords(c, []byte{kListDataKeyPrefix}, false, nil, nil); len(ks) != 5 {
+		t.Errorf("expect 5 data keys, get %v", len(ks))
+	}
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+)
+
+func (h *DbHandler) Sadd(c *redisClient, key []byte, members ...[]byte) (int, error) {
+	defer locks.lock(c, key)()
+	defer h.compactView(c)()
+	metaKey := encodeMetaKey(c.arena, key)
+	old, err := getMeta(c, metaKey, kTypeSet)
+	if err != nil {
+		return 0, err
+	}
+	set := Set(old)
+	if old == nil {
+		set = NewSet(c.arena)
+	}
+
+	ks, vs := createKvs(len(members) + 1)
+	ks[0], vs[0] = metaKey, set
+	added := 1
+	for _, member := range members {
+		mKey := setMemberKey(c.arena, metaKey, member)
+		if containsKey(ks[1:added], mKey) {
+			continue
+		}
+		if old != nil {
+			if v, err := c.db.Get(c.arena, mKey); err != nil {
+				return 0, err
+			} else if v != nil {
+				continue
+			}
+		}
+		ks[added], vs[added] = mKey, []byte{}
+		added += 1
+	}
+
+	if added == 1 {
+		return 0, nil
+	}
+	set.setSize(set.size() + added - 1)
+	return added - 1, c.db.Batch(ks[:added], vs[:added])
+}
+
+// remove the given members, which should all exist, in one batch
+func (h *DbHandler) removeMembers(c *redisClient, metaKey []byte, set Set, members [][]byte) error {
+	ks, vs := createKvs(len(members) + 1)
+	ks[0], vs[0] = metaKey, set
+	if len(members) >= set.size() {
+		vs[0] = nil // the last member is gone, remove the set
+	} else {
+		set.setSize(set.size() - len(members))
+	}
+	for i, member := range members {
+		ks[i+1] = setMemberKey(c.arena, metaKey, member)
+	}
+	return c.db.Batch(ks, vs)
+}
+
+func (h *DbHandler) Srem(c *redisClient, key []byte, members ...[]byte) (int, error) {
+	defer locks.lock(c, key)()
+	defer h.compactView(c)()
+	metaKey := encodeMetaKey(c.arena, key)
+	if old, err := getMeta(c, metaKey, kTypeSet); err != nil || old == nil {
+		return 0, err
+	} else {
+		removed := make([][]byte, 0, len(members))
+		for _, member := range members {
+			if v, err := c.db.Get(c.arena, setMemberKey(c.arena, metaKey, member)); err != nil {
+				return 0, err
+			} else if v != nil && !containsKey(removed, member) {
+				removed = append(removed, member)
+			}
+		}
+		if len(removed) == 0 {
+			return 0, nil
+		}
+		return len(removed), h.removeMembers(c, metaKey, Set(old), removed)
+	}
+}
+
+func (h *DbHandler) Smembers(c *redisClient, key []byte) ([][]byte, error) {
+	defer h.compactView(c)()
+	result := make([][]byte, 0)
+	metaKey := encodeMetaKey(c.arena, key)
+	if old, err := getMeta(c, metaKey, kTypeSet); err != nil || old == nil {
+		return result, err
+	}
+	prefix := setMemberKey(c.arena, metaKey, nil)
+	err := scanMembers(c, prefix, func(member, value []byte) bool {
+		result = append(result, member)
+		return true
+	})
+	return result, err
+}
+
+func (h *DbHandler) Sismember(c *redisClient, key, member []byte) (int, error) {
+	defer h.compactView(c)()
+	metaKey := encodeMetaKey(c.arena, key)
+	if old, err := getMeta(c, metaKey, kTypeSet); err != nil || old == nil {
+		return 0, err
+	}
+	if v, err := c.db.Get(c.arena, setMemberKey(c.arena, metaKey, member)); err != nil || v == nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func (h *DbHandler) Scard(c *redisClient, key []byte) (int, error) {
+	if old, err := getMeta(c, encodeMetaKey(c.arena, key), kTypeSet); err != nil || old == nil {
+		return 0, err
+	} else {
+		return Set(old).size(), nil
+	}
+}
+
+// SPOP key [count]
+func (h *DbHandler) Spop(c *redisClient, key []byte, args ...[]byte) (Reply, error) {
+	count, withCount, err := parseOptionalCount(args)
+	if err != nil || count < 0 {
+		return nil, ErrExpectPositivInteger
+	}
+	defer locks.lock(c, key)()
+	defer h.compactView(c)()
+
+	metaKey := encodeMetaKey(c.arena, key)
+	old, err := getMeta(c, metaKey, kTypeSet)
+	if err != nil || old == nil {
+		if withCount {
+			return MultiBulkReply{[][]byte{}}, err
+		}
+		return BulkReply{nil}, err
+	}
+
+	members, err := randomMembers(c, metaKey, Set(old).size(), count, true)
+	if err == nil && len(members) > 0 {
+		err = h.removeMembers(c, metaKey, Set(old), members)
+	}
+	if withCount {
+		return MultiBulkReply{members}, err
+	} else if len(members) > 0 {
+		return BulkReply{members[0]}, err
+	}
+	return BulkReply{nil}, err
+}
+
+// SRANDMEMBER key [count]
+func (h *DbHandler) Srandmember(c *redisClient, key []byte, args ...[]byte) (Reply, error) {
+	defer h.compactView(c)()
+	count, withCount, err := parseOptionalCount(args)
+	if err != nil {
+		return nil, ErrExpectInteger
+	}
+
+	metaKey := encodeMetaKey(c.arena, key)
+	old, err := getMeta(c, metaKey, kTypeSet)
+	if err != nil || old == nil {
+		if withCount {
+			return MultiBulkReply{[][]byte{}}, err
+		}
+		return BulkReply{nil}, err
+	}
+
+	// negative count: the same member may be returned multiple times
+	distinct := count >= 0
+	if !distinct {
+		count = -count
+	}
+	members, err := randomMembers(c, metaKey, Set(old).size(), count, distinct)
+	if withCount {
+		return MultiBulkReply{members}, err
+	} else if len(members) > 0 {
+		return BulkReply{members[0]}, err
+	}
+	return BulkReply{nil}, err
+}
+
+func parseOptionalCount(args [][]byte) (count int, withCount bool, err error) {
+	if len(args) > 1 {
+		return 0, false, ErrTooMuchArgs
+	} else if len(args) == 0 {
+		return 1, false, nil
+	}
+	count, err = strconv.Atoi(string(args[0]))
+	return count, true, err
+}
+
+// pick count members from a set of size members. Every pick seeks to a random
+// point in the member key range, which is O(log n) but favors members after
+// large gaps. When most of the set is wanted, a full scan is cheaper.
+func randomMembers(c *redisClient, metaKey []byte, size, count int, distinct bool) ([][]byte, error) {
+	prefix := setMemberKey(c.arena, metaKey, nil)
+	if distinct && count*2 >= size {
+		all := make([][]byte, 0, size)
+		err := scanMembers(c, prefix, func(member, value []byte) bool {
+			all = append(all, member)
+			return true
+		})
+		rand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+		if count < len(all) {
+			all = all[:count]
+		}
+		return all, err
+	}
+
+	result := make([][]byte, 0, count)
+	start := make([]byte, len(prefix)+8)
+	copy(start, prefix)
+	for len(result) < count {
+		rand.Read(start[len(prefix):])
+		var picked []byte
+		err := scanMembersFrom(c, prefix, start, func(member, value []byte) bool {
+			picked = member
+			return false
+		})
+		if err == nil && picked == nil { // after the last member, wrap around
+			err = scanMembers(c, prefix, func(member, value []byte) bool {
+				picked = member
+				return false
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+		if picked == nil {
+			break
+		}
+		if !distinct || !containsKey(result, picked) {
+			result = append(result, picked)
+		}
+	}
+	return result, nil
+}
+
+// a pull style iterator over the members of a set, in member order. Members are
+// read by Store.Scan in small windows, so a merge join never loads a whole set
+type memberCursor struct {
+	c       *redisClient
+	prefix  []byte
+	next    []byte // scan from here when the window is used up
+	members [][]byte
+	pos     int
+	done    bool
+}
+
+const memberCursorWindow = 128
+
+func newMemberCursor(c *redisClient, prefix []byte) *memberCursor {
+	return &memberCursor{c: c, prefix: prefix, next: prefix}
+}
+
+func (mc *memberCursor) fill() error {
+	mc.members, mc.pos = mc.members[:0], 0
+	err := mc.c.db.Scan(mc.c.arena, mc.next, func(k, v []byte) bool {
+		if !bytes.HasPrefix(k, mc.prefix) {
+			return false
+		}
+		mc.members = append(mc.members, k[len(mc.prefix):])
+		mc.next = k
+		return len(mc.members) < memberCursorWindow
+	})
+	if len(mc.members) < memberCursorWindow {
+		mc.done = true
+	} else {
+		mc.next = append(mc.next[:len(mc.next):len(mc.next)], 0) // right after the last one
+	}
+	return err
+}
+
+// current member, nil when exhausted
+func (mc *memberCursor) peek() ([]byte, error) {
+	if mc.pos < len(mc.members) {
+		return mc.members[mc.pos], nil
+	}
+	if mc.done {
+		return nil, nil
+	}
+	if err := mc.fill(); err != nil {
+		return nil, err
+	}
+	return mc.peek()
+}
+
+// move to the first member >= target, seek instead of walking if it is out of the window
+func (mc *memberCursor) advanceTo(target []byte) error {
+	if n := len(mc.members); n > 0 && bytes.Compare(mc.members[n-1], target) < 0 && !mc.done {
+		mc.members, mc.pos = mc.members[:0], 0
+		mc.next = append(append(make([]byte, 0, len(mc.prefix)+len(target)), mc.prefix...), target...)
+		return nil
+	}
+	for {
+		if m, err := mc.peek(); err != nil || m == nil || bytes.Compare(m, target) >= 0 {
+			return err
+		}
+		mc.pos += 1
+	}
+}
+
+func (h *DbHandler) setCursors(c *redisClient, keys [][]byte) ([]*memberCursor, error) {
+	cursors := make([]*memberCursor, len(keys))
+	for i, key := range keys {
+		metaKey := encodeMetaKey(c.arena, key)
+		cursors[i] = newMemberCursor(c, setMemberKey(c.arena, metaKey, nil))
+		if old, err := getMeta(c, metaKey, kTypeSet); err != nil {
+			return nil, err
+		} else if old == nil {
+			cursors[i].done = true // no members
+		}
+	}
+	return cursors, nil
+}
+
+func (h *DbHandler) sinter(c *redisClient, keys [][]byte) ([][]byte, error) {
+	result := make([][]byte, 0)
+	if len(keys) == 0 {
+		return nil, ErrWrongArgsNumber
+	}
+	cursors, err := h.setCursors(c, keys)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		// every cursor catches up with the biggest head, a match if they all land on it
+		var max []byte
+		for _, mc := range cursors {
+			if m, err := mc.peek(); err != nil || m == nil {
+				return result, err
+			} else if bytes.Compare(m, max) > 0 {
+				max = m
+			}
+		}
+		matched := true
+		for _, mc := range cursors {
+			if err := mc.advanceTo(max); err != nil {
+				return nil, err
+			}
+			if m, err := mc.peek(); err != nil || m == nil {
+				return result, err
+			} else if !bytes.Equal(m, max) {
+				matched = false
+			}
+		}
+		if matched {
+			result = append(result, max)
+			for _, mc := range cursors {
+				mc.pos += 1
+			}
+		}
+	}
+}
+
+func (h *DbHandler) sunion(c *redisClient, keys [][]byte) ([][]byte, error) {
+	result := make([][]byte, 0)
+	if len(keys) == 0 {
+		return nil, ErrWrongArgsNumber
+	}
+	cursors, err := h.setCursors(c, keys)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var min []byte
+		for _, mc := range cursors {
+			if m, err := mc.peek(); err != nil {
+				return nil, err
+			} else if m != nil && (min == nil || bytes.Compare(m, min) < 0) {
+				min = m
+			}
+		}
+		if min == nil {
+			return result, nil
+		}
+		result = append(result, min)
+		for _, mc := range cursors {
+			if m, _ := mc.peek(); m != nil && bytes.Equal(m, min) {
+				mc.pos += 1
+			}
+		}
+	}
+}
+
+func (h *DbHandler) sdiff(c *redisClient, keys [][]byte) ([][]byte, error) {
+	result := make([][]byte, 0)
+	if len(keys) == 0 {
+		return nil, ErrWrongArgsNumber
+	}
+	cursors, err := h.setCursors(c, keys)
+	if err != nil {
+		return nil, err
+	}
+	first, others := cursors[0], cursors[1:]
+	for {
+		m, err := first.peek()
+		if err != nil || m == nil {
+			return result, err
+		}
+		found := false
+		for _, mc := range others {
+			if err := mc.advanceTo(m); err != nil {
+				return nil, err
+			}
+			if o, err := mc.peek(); err != nil {
+				return nil, err
+			} else if o != nil && bytes.Equal(o, m) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, m)
+		}
+		first.pos += 1
+	}
+}
+
+// replace dst, whatever type it is, with members in one batch, an empty result removes dst
+func (h *DbHandler) storeSet(c *redisClient, dst []byte, members [][]byte) (int, error) {
+	metaKey := encodeMetaKey(c.arena, dst)
+	var ks, vs [][]byte
+	if old, err := getMeta(c, metaKey, 0); err != nil {
+		return 0, err
+	} else if old != nil {
+		if ks, _, err = keyRecords(c, metaKey, old, false); err != nil {
+			return 0, err
+		}
+		vs = make([][]byte, len(ks))
+	}
+
+	set := NewSet(c.arena)
+	set.setSize(len(members))
+	if len(members) == 0 {
+		set = nil
+	}
+	ks, vs = append(ks, metaKey), append(vs, set)
+	for _, member := range members { // puts come after the deletes, so they win
+		ks, vs = append(ks, setMemberKey(c.arena, metaKey, member)), append(vs, []byte{})
+	}
+	return len(members), c.db.Batch(ks, vs)
+}
+
+func (h *DbHandler) Sinter(c *redisClient, keys ...[]byte) ([][]byte, error) {
+	defer h.compactView(c)()
+	return h.sinter(c, keys)
+}
+
+func (h *DbHandler) Sunion(c *redisClient, keys ...[]byte) ([][]byte, error) {
+	defer h.compactView(c)()
+	return h.sunion(c, keys)
+}
+
+func (h *DbHandler) Sdiff(c *redisClient, keys ...[]byte) ([][]byte, error) {
+	defer h.compactView(c)()
+	return h.sdiff(c, keys)
+}
+
+func (h *DbHandler) Sinterstore(c *redisClient, dst []byte, keys ...[]byte) (int, error) {
+	defer locks.lock(c, append([][]byte{dst}, keys...)...)()
+	defer h.compactView(c)()
+	if members, err := h.sinter(c, keys); err != nil {
+		return 0, err
+	} else {
+		return h.storeSet(c, dst, members)
+	}
+}
+
+func (h *DbHandler) Sunionstore(c *redisClient, dst []byte, keys ...[]byte) (int, error) {
+	defer locks.lock(c, append([][]byte{dst}, keys...)...)()
+	defer h.compactView(c)()
+	if members, err := h.sunion(c, keys); err != nil {
+		return 0, err
+	} else {
+		return h.storeSet(c, dst, members)
+	}
+}
+
+func (h *DbHandler) Sdiffstore(c *redisClient, dst []byte, keys ...[]byte) (int, error) {
+	defer locks.lock(c, append([][]byte{dst}, keys...)...)()
+	defer h.compactView(c)()
+	if members, err := h.sdiff(c, keys); err != nil {
+		return 0, err
+	} else {
+		return h.storeSet(c, dst, members)
+	}
+}
+
+// SSCAN key cursor [MATCH pattern] [COUNT count]
+func (h *DbHandler) Sscan(c *redisClient, key, cursor []byte, args ...[]byte) (Reply, error) {
+	defer h.compactView(c)()
+	return scanCollection(c, key, kTypeSet, kSetMemberKeyPrefix, cursor, args,
+		func(out [][]byte, member, _ []byte) [][]byte {
+			return append(out, member)
+		})
+}
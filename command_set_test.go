@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSetCommands(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+
+	key := []byte("tags")
+	members := [][]byte{[]byte("go"), []byte("redis"), []byte("rocksdb"), []byte("go")}
+	if n, err := h.Sadd(c, key, members...); n != 3 || err != nil {
+		t.Errorf("expect 3 members added, get %v, %v", n, err)
+	}
+	if n, _ := h.Sadd(c, key, []byte("go")); n != 0 {
+		t.Errorf("expect 0 added, get %v", n)
+	}
+	if n, _ := h.Sismember(c, key, []byte("redis")); n != 1 {
+		t.Error("redis should be a member")
+	}
+
+	if r, err := h.Srandmember(c, key, []byte("-5")); len(r.(MultiBulkReply).values) != 5 || err != nil {
+		t.Errorf("expect 5 members, get %q, %v", r, err)
+	}
+	if r, _ := h.Srandmember(c, key, []byte("2")); len(r.(MultiBulkReply).values) != 2 {
+		t.Errorf("expect 2 distinct members, get %q", r)
+	}
+
+	r, err := h.Spop(c, key)
+	popped := r.(BulkReply).value
+	if err != nil || popped == nil {
+		t.Fatalf("expect a member, get %q, %v", popped, err)
+	}
+	if n, _ := h.Sismember(c, key, popped); n != 0 {
+		t.Errorf("%s should be popped", popped)
+	}
+	if n, _ := h.Scard(c, key); n != 2 {
+		t.Errorf("expect 2 members left, get %v", n)
+	}
+
+	left, _ := h.Smembers(c, key)
+	if n, _ := h.Srem(c, key, left...); n != 2 {
+		t.Errorf("expect 2 members removed, get %v", n)
+	}
+	if n, _ := h.Scard(c, key); n != 0 {
+		t.Errorf("expect set removed, get %v", n)
+	}
+}
+
+func TestSetAlgebra(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+
+	// more members than one cursor window
+	for i := 0; i < 300; i++ {
+		m := []byte(fmt.Sprintf("%03d", i))
+		h.Sadd(c, []byte("all"), m)
+		if i%2 == 0 {
+			h.Sadd(c, []byte("even"), m)
+		}
+		if i%3 == 0 {
+			h.Sadd(c, []byte("three"), m)
+		}
+	}
+
+	if r, err := h.Sinter(c, []byte("all"), []byte("even"), []byte("three")); len(r) != 50 || err != nil {
+		t.Errorf("expect 50 members, get %v, %v", len(r), err)
+	} else if string(r[1]) != "006" {
+		t.Errorf("expect 006, get %s", r[1])
+	}
+	if r, err := h.Sunion(c, []byte("even"), []byte("three"), []byte("none")); len(r) != 200 || err != nil {
+		t.Errorf("expect 200 members, get %v, %v", len(r), err)
+	}
+	if r, err := h.Sdiff(c, []byte("all"), []byte("even"), []byte("three")); len(r) != 100 || err != nil {
+		t.Errorf("expect 100 members, get %v, %v", len(r), err)
+	}
+	if r, _ := h.Sinter(c, []byte("all"), []byte("none")); len(r) != 0 {
+		t.Errorf("expect empty, get %v", len(r))
+	}
+
+	if n, err := h.Sinterstore(c, []byte("all"), []byte("all"), []byte("three")); n != 100 || err != nil {
+		t.Errorf("expect 100 members stored, get %v, %v", n, err)
+	}
+	if n, _ := h.Scard(c, []byte("all")); n != 100 {
+		t.Errorf("expect 100 members, get %v", n)
+	}
+	if r, _ := h.Smembers(c, []byte("all")); len(r) != 100 {
+		t.Errorf("expect 100 members, get %v", len(r))
+	}
+}
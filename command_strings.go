@@ -1,19 +1,407 @@
 package main
 
-// import "fmt"
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// SETRANGE and APPEND may not grow a value past this, like redis
+const maxStringSize = 512 * 1024 * 1024
 
 func (h *DbHandler) Get(c *redisClient, key []byte) ([]byte, error) {
-	return c.db.Get(c.arena, key)
+	_, _, value, err := getString(c, key)
+	return value, err
+}
+
+// append to ks, vs the records that save value at key, which expires at unix
+// ms at, 0 for never. Whatever key holds is replaced
+func stringRecords(c *redisClient, key, value []byte, at int64, ks, vs [][]byte) ([][]byte, [][]byte, error) {
+	mKey := encodeMetaKey(c.arena, key)
+	v := newMeta(c.arena, kTypeString, len(value))
+	copy(v[kMetaHeaderSize:], value)
+
+	old, err := getMeta(c, mKey, 0)
+	if err != nil {
+		return ks, vs, err
+	}
+	if old != nil && metaType(old) != kTypeString { // remove data keys of the old value
+		dks, _, err := keyRecords(c, mKey, old, false)
+		if err != nil {
+			return ks, vs, err
+		}
+		ks, vs = append(ks, dks...), append(vs, make([][]byte, len(dks))...)
+	}
+	if at != 0 {
+		setMetaExpireAt(v, at)
+		ks, vs = append(ks, expireIndexKey(c.arena, at, mKey)), append(vs, []byte{})
+	}
+	return append(ks, mKey), append(vs, v), nil // after the delete of mKey
 }
 
-func (h *DbHandler) Set(c *redisClient, key, value []byte) error {
-	return c.db.Set(key, value)
+func setString(c *redisClient, key, value []byte, at int64) error {
+	ks, vs, err := stringRecords(c, key, value, at, nil, nil)
+	if err != nil {
+		return err
+	}
+	if len(ks) == 1 {
+		return c.db.Set(ks[0], vs[0])
+	}
+	return c.db.Batch(ks, vs)
 }
 
-func (h *DbHandler) Del(c *redisClient, key []byte) error {
-	return c.db.Delete(key)
+// the meta key of string key, its meta and value, meta is nil if key is missing.
+// A bitmap is a string too
+func getString(c *redisClient, key []byte) (mKey, meta, value []byte, err error) {
+	mKey = encodeMetaKey(c.arena, key)
+	if meta, err = getMeta(c, mKey, 0); err != nil || meta == nil {
+		return mKey, nil, nil, err
+	} else if t := metaType(meta); t != kTypeString && t != kTypeBitmap {
+		return mKey, nil, nil, ErrWrongType
+	}
+	value, err = stringValue(c, mKey, meta)
+	return
 }
 
-// func (h *DbHandler) Setex(c *redisClient, key, value []byte, expire int) error {
-// 	return nil
-// }
+// give string key a new value, keeping its ttl. old is its current meta, or
+// nil. A bitmap becomes a plain string, its pages are deleted
+func updateString(c *redisClient, mKey, old, value []byte) error {
+	v := newMeta(c.arena, kTypeString, len(value))
+	copy(v[kMetaHeaderSize:], value)
+	if old != nil {
+		setMetaExpireAt(v, metaExpireAt(old))
+	}
+	if old == nil || metaType(old) == kTypeString {
+		return c.db.Set(mKey, v)
+	}
+	ks, _, err := keyRecords(c, mKey, old, false)
+	if err != nil {
+		return err
+	}
+	vs := make([][]byte, len(ks))
+	vs[0] = v
+	return c.db.Batch(ks, vs)
+}
+
+type setOptions struct {
+	nx, xx, keepTTL, get bool
+	at                   int64 // unix ms, 0 for never
+}
+
+// EX seconds | PX ms | EXAT timestamp | PXAT ms-timestamp | KEEPTTL, NX | XX, GET
+func parseSetOptions(args [][]byte) (opts setOptions, err error) {
+	expires := 0
+	for i := 0; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX":
+			opts.nx = true
+		case "XX":
+			opts.xx = true
+		case "GET":
+			opts.get = true
+		case "KEEPTTL":
+			opts.keepTTL, expires = true, expires+1
+		case "EX", "PX", "EXAT", "PXAT":
+			if i+1 >= len(args) {
+				return opts, ErrSyntax
+			}
+			i, expires = i+1, expires+1
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return opts, ErrExpectInteger
+			} else if n <= 0 {
+				return opts, ErrInvalidExpire
+			}
+			switch opt {
+			case "EX":
+				opts.at = nowMs() + n*1000
+			case "PX":
+				opts.at = nowMs() + n
+			case "EXAT":
+				opts.at = n * 1000
+			case "PXAT":
+				opts.at = n
+			}
+		default:
+			return opts, ErrSyntax
+		}
+	}
+	if (opts.nx && opts.xx) || expires > 1 {
+		return opts, ErrSyntax
+	}
+	return
+}
+
+// SET key value [NX | XX] [GET] [EX seconds | PX ms | EXAT timestamp | PXAT ms-timestamp | KEEPTTL]
+// A nil reply when NX or XX stops the write, or the old value with GET
+func (h *DbHandler) Set(c *redisClient, key, value []byte, args ...[]byte) (Reply, error) {
+	opts, err := parseSetOptions(args)
+	if err != nil {
+		return nil, err
+	}
+	defer locks.lock(c, key)()
+	mKey, meta, err := findKey(c, key)
+	if err != nil {
+		return nil, err
+	}
+	var old []byte
+	if opts.get && mKey != nil {
+		if _, _, old, err = getString(c, key); err != nil {
+			return nil, err
+		}
+	}
+	if (opts.nx && mKey != nil) || (opts.xx && mKey == nil) {
+		return BulkReply{old}, nil
+	}
+	if opts.keepTTL && mKey != nil {
+		opts.at = metaExpireAt(meta)
+	}
+	if err := setString(c, key, value, opts.at); err != nil {
+		return nil, err
+	}
+	if opts.get {
+		return BulkReply{old}, nil
+	}
+	return StatusReply{"OK"}, nil
+}
+
+func (h *DbHandler) Setex(c *redisClient, key []byte, seconds int, value []byte) error {
+	if seconds <= 0 {
+		return ErrInvalidExpire
+	}
+	defer locks.lock(c, key)()
+	return setString(c, key, value, nowMs()+int64(seconds)*1000)
+}
+
+func (h *DbHandler) Psetex(c *redisClient, key []byte, ms int, value []byte) error {
+	if ms <= 0 {
+		return ErrInvalidExpire
+	}
+	defer locks.lock(c, key)()
+	return setString(c, key, value, nowMs()+int64(ms))
+}
+
+func (h *DbHandler) Setnx(c *redisClient, key, value []byte) (int, error) {
+	defer locks.lock(c, key)()
+	if mKey, _, err := findKey(c, key); err != nil || mKey != nil {
+		return 0, err
+	}
+	return 1, setString(c, key, value, 0)
+}
+
+func (h *DbHandler) Getset(c *redisClient, key, value []byte) ([]byte, error) {
+	defer locks.lock(c, key)()
+	_, _, old, err := getString(c, key)
+	if err != nil {
+		return nil, err
+	}
+	return old, setString(c, key, value, 0)
+}
+
+// read, add delta and write back, all under the lock of key
+func incrBy(c *redisClient, key []byte, delta int64) (int64, error) {
+	defer locks.lock(c, key)()
+	mKey := encodeMetaKey(c.arena, key)
+	meta, err := getMeta(c, mKey, 0)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if meta != nil {
+		if metaType(meta) == kTypeBitmap {
+			return 0, ErrExpectInteger // a string too long for a number
+		} else if metaType(meta) != kTypeString {
+			return 0, ErrWrongType
+		}
+		if n, err = strconv.ParseInt(string(meta[kMetaHeaderSize:]), 10, 64); err != nil {
+			return 0, ErrExpectInteger
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrIncrOverflow
+	}
+	n += delta
+	return n, updateString(c, mKey, meta, strconv.AppendInt(nil, n, 10))
+}
+
+func (h *DbHandler) Incr(c *redisClient, key []byte) (int, error) {
+	n, err := incrBy(c, key, 1)
+	return int(n), err
+}
+
+func (h *DbHandler) Decr(c *redisClient, key []byte) (int, error) {
+	n, err := incrBy(c, key, -1)
+	return int(n), err
+}
+
+func (h *DbHandler) Incrby(c *redisClient, key []byte, delta int) (int, error) {
+	n, err := incrBy(c, key, int64(delta))
+	return int(n), err
+}
+
+func (h *DbHandler) Decrby(c *redisClient, key []byte, delta int) (int, error) {
+	if delta == math.MinInt64 {
+		return 0, ErrIncrOverflow
+	}
+	n, err := incrBy(c, key, -int64(delta))
+	return int(n), err
+}
+
+func (h *DbHandler) Incrbyfloat(c *redisClient, key, incr []byte) ([]byte, error) {
+	delta, err := strconv.ParseFloat(string(incr), 64)
+	if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+		return nil, ErrExpectFloat
+	}
+	defer locks.lock(c, key)()
+	mKey, old, value, err := getString(c, key)
+	if err != nil {
+		return nil, err
+	}
+	var f float64
+	if old != nil {
+		if f, err = strconv.ParseFloat(string(value), 64); err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, ErrExpectFloat
+		}
+	}
+	if f += delta; math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, ErrIncrNaN
+	}
+	v := strconv.AppendFloat(nil, f, 'f', -1, 64)
+	return v, updateString(c, mKey, old, v)
+}
+
+// a bitmap's pages are not read
+func (h *DbHandler) Strlen(c *redisClient, key []byte) (int, error) {
+	b, err := loadBitmap(c, key)
+	if err != nil {
+		return 0, err
+	}
+	return b.size, nil
+}
+
+func (h *DbHandler) Append(c *redisClient, key, value []byte) (int, error) {
+	defer locks.lock(c, key)()
+	mKey, old, v, err := getString(c, key)
+	if err != nil {
+		return 0, err
+	}
+	if len(v)+len(value) > maxStringSize {
+		return 0, ErrStringTooLong
+	}
+	v = append(append(make([]byte, 0, len(v)+len(value)), v...), value...)
+	return len(v), updateString(c, mKey, old, v)
+}
+
+// GETRANGE key start end, both inclusive, negative counts from the end
+func (h *DbHandler) Getrange(c *redisClient, key []byte, start, end int) ([]byte, error) {
+	_, _, value, err := getString(c, key)
+	if err != nil {
+		return nil, err
+	}
+	size := len(value)
+	if start < 0 {
+		start += size
+	}
+	if end < 0 {
+		end += size
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= size {
+		end = size - 1
+	}
+	if start > end || size == 0 {
+		return []byte{}, nil
+	}
+	return value[start : end+1], nil
+}
+
+// overwrite value from offset on, padding with zero bytes if it's shorter
+func (h *DbHandler) Setrange(c *redisClient, key []byte, offset int, value []byte) (int, error) {
+	if offset < 0 {
+		return 0, ErrOffsetOutOfRange
+	}
+	if offset+len(value) > maxStringSize {
+		return 0, ErrStringTooLong
+	}
+	defer locks.lock(c, key)()
+	mKey, old, v, err := getString(c, key)
+	if err != nil || len(value) == 0 { // nothing to write, not even a new key
+		return len(v), err
+	}
+	size := len(v)
+	if offset+len(value) > size {
+		size = offset + len(value)
+	}
+	nv := make([]byte, size)
+	copy(nv, v)
+	copy(nv[offset:], value)
+	return size, updateString(c, mKey, old, nv)
+}
+
+// keys not holding a string are nil, like missing ones
+func (h *DbHandler) Mget(c *redisClient, keys ...[]byte) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		_, _, value, err := getString(c, key)
+		if err != nil && err != ErrWrongType {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// all pairs are written in one batch
+func msetRecords(c *redisClient, kvs [][]byte) (ks, vs [][]byte, err error) {
+	for i := 0; i < len(kvs) && err == nil; i += 2 {
+		ks, vs, err = stringRecords(c, kvs[i], kvs[i+1], 0, ks, vs)
+	}
+	return
+}
+
+func checkPairs(kvs [][]byte) ([][]byte, error) {
+	if len(kvs) == 0 {
+		return nil, ErrExpectMorePair
+	} else if len(kvs)%2 != 0 {
+		return nil, ErrExpectEvenPair
+	}
+	keys := make([][]byte, 0, len(kvs)/2)
+	for i := 0; i < len(kvs); i += 2 {
+		keys = append(keys, kvs[i])
+	}
+	return keys, nil
+}
+
+func (h *DbHandler) Mset(c *redisClient, kvs ...[]byte) error {
+	keys, err := checkPairs(kvs)
+	if err != nil {
+		return err
+	}
+	defer locks.lock(c, keys...)()
+	ks, vs, err := msetRecords(c, kvs)
+	if err != nil {
+		return err
+	}
+	return c.db.Batch(ks, vs)
+}
+
+// set all pairs only if none of the keys exists
+func (h *DbHandler) Msetnx(c *redisClient, kvs ...[]byte) (int, error) {
+	keys, err := checkPairs(kvs)
+	if err != nil {
+		return 0, err
+	}
+	defer locks.lock(c, keys...)()
+	for _, key := range keys {
+		if mKey, _, err := findKey(c, key); err != nil || mKey != nil {
+			return 0, err
+		}
+	}
+	ks, vs, err := msetRecords(c, kvs)
+	if err != nil {
+		return 0, err
+	}
+	return 1, c.db.Batch(ks, vs)
+}
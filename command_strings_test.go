@@ -0,0 +1,233 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStringCommands(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+
+	if n, _ := h.Incr(c, []byte("n")); n != 1 {
+		t.Errorf("expect 1, get %v", n)
+	}
+	if n, _ := h.Incrby(c, []byte("n"), 10); n != 11 {
+		t.Errorf("expect 11, get %v", n)
+	}
+	if n, _ := h.Decrby(c, []byte("n"), 20); n != -9 {
+		t.Errorf("expect -9, get %v", n)
+	}
+	if v, _ := h.Incrbyfloat(c, []byte("n"), []byte("0.5")); string(v) != "-8.5" {
+		t.Errorf("expect -8.5, get %s", v)
+	}
+	if _, err := h.Incr(c, []byte("n")); err != ErrExpectInteger {
+		t.Errorf("expect integer error, get %v", err)
+	}
+	h.Set(c, []byte("n"), []byte("9223372036854775807"))
+	if _, err := h.Incr(c, []byte("n")); err != ErrIncrOverflow {
+		t.Errorf("expect overflow, get %v", err)
+	}
+
+	// counters keep their ttl
+	h.Setex(c, []byte("ttl"), 100, []byte("1"))
+	h.Incr(c, []byte("ttl"))
+	if n, _ := h.Ttl(c, []byte("ttl")); n != 100 {
+		t.Errorf("expect 100, get %v", n)
+	}
+
+	if n, _ := h.Append(c, []byte("s"), []byte("Hello")); n != 5 {
+		t.Errorf("expect 5, get %v", n)
+	}
+	h.Append(c, []byte("s"), []byte(" World"))
+	if v, _ := h.Getrange(c, []byte("s"), -5, -1); string(v) != "World" {
+		t.Errorf("expect World, get %s", v)
+	}
+	if v, _ := h.Getrange(c, []byte("s"), 0, 100); string(v) != "Hello World" {
+		t.Errorf("expect Hello World, get %s", v)
+	}
+	if n, _ := h.Setrange(c, []byte("s"), 6, []byte("Redis")); n != 11 {
+		t.Errorf("expect 11, get %v", n)
+	}
+	if n, _ := h.Setrange(c, []byte("pad"), 3, []byte("x")); n != 4 {
+		t.Errorf("expect 4, get %v", n)
+	}
+	if v, _ := h.Get(c, []byte("pad")); string(v) != "\x00\x00\x00x" {
+		t.Errorf("expect zero padding, get %q", v)
+	}
+	if n, _ := h.Strlen(c, []byte("s")); n != 11 {
+		t.Errorf("expect 11, get %v", n)
+	}
+
+	if v, _ := h.Getset(c, []byte("s"), []byte("new")); string(v) != "Hello Redis" {
+		t.Errorf("expect Hello Redis, get %s", v)
+	}
+	if n, _ := h.Setnx(c, []byte("s"), []byte("x")); n != 0 {
+		t.Errorf("expect 0, get %v", n)
+	}
+	if n, _ := h.Setnx(c, []byte("s2"), []byte("x")); n != 1 {
+		t.Errorf("expect 1, get %v", n)
+	}
+
+	// MSET replaces keys of any type
+	h.Rpush(c, []byte("list"), []byte("a"))
+	if err := h.Mset(c, []byte("list"), []byte("1"), []byte("k"), []byte("2")); err != nil {
+		t.Error(err)
+	}
+	if ks, _, _ := scanRecords(c, []byte{kListDataKeyPrefix}, false, nil, nil); len(ks) != 0 {
+		t.Errorf("expect list data deleted, get %q", ks)
+	}
+	h.Sadd(c, []byte("set"), []byte("a"))
+	vs, _ := h.Mget(c, []byte("list"), []byte("k"), []byte("none"), []byte("set"))
+	if string(vs[0]) != "1" || string(vs[1]) != "2" || vs[2] != nil || vs[3] != nil {
+		t.Errorf("expect [1 2 nil nil], get %q", vs)
+	}
+	if n, _ := h.Msetnx(c, []byte("k"), []byte("3"), []byte("k3"), []byte("3")); n != 0 {
+		t.Errorf("expect 0, get %v", n)
+	}
+	if v, _ := h.Get(c, []byte("k3")); v != nil {
+		t.Errorf("expect nothing set, get %s", v)
+	}
+	if n, _ := h.Msetnx(c, []byte("k3"), []byte("3"), []byte("k4"), []byte("4")); n != 1 {
+		t.Errorf("expect 1, get %v", n)
+	}
+	if err := h.Mset(c, []byte("k")); err != ErrExpectEvenPair {
+		t.Errorf("expect uneven error, get %v", err)
+	}
+}
+
+func TestIncrConcurrent(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cc := NewReisClient(&MockConn{})
+			cc.db = c.db
+			for j := 0; j < 200; j++ {
+				h.Incr(cc, []byte("n"))
+				cc.arena.Reset()
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := h.Get(c, []byte("n")); string(v) != "1600" {
+		t.Errorf("expect 1600, get %s", v)
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+
+	set := func(value string, args ...string) Reply {
+		bs := make([][]byte, len(args))
+		for i, arg := range args {
+			bs[i] = []byte(arg)
+		}
+		r, err := h.Set(c, []byte("k"), []byte(value), bs...)
+		if err != nil {
+			return ErrorReply{err.Error()}
+		}
+		return r
+	}
+	if r := set("v", "XX"); r.(BulkReply).value != nil {
+		t.Errorf("expect nil, get %v", r)
+	}
+	if r := set("v", "NX", "EX", "100"); r != (StatusReply{"OK"}) {
+		t.Errorf("expect OK, get %v", r)
+	}
+	if n, _ := h.Ttl(c, []byte("k")); n != 100 {
+		t.Errorf("expect 100, get %v", n)
+	}
+	if r := set("v2", "NX", "GET"); string(r.(BulkReply).value) != "v" {
+		t.Errorf("expect v, get %v", r)
+	}
+	if r := set("v2", "XX", "KEEPTTL", "GET"); string(r.(BulkReply).value) != "v" {
+		t.Errorf("expect v, get %v", r)
+	}
+	if n, _ := h.Ttl(c, []byte("k")); n != 100 {
+		t.Errorf("expect ttl kept, get %v", n)
+	}
+	set("v3", "PX", "50000")
+	if n, _ := h.Ttl(c, []byte("k")); n != 50 {
+		t.Errorf("expect 50, get %v", n)
+	}
+	set("v4")
+	if n, _ := h.Ttl(c, []byte("k")); n != -1 {
+		t.Errorf("expect ttl cleared, get %v", n)
+	}
+	if v, _ := h.Get(c, []byte("k")); string(v) != "v4" {
+		t.Errorf("expect v4, get %s", v)
+	}
+
+	for _, args := range [][]string{{"NX", "XX"}, {"EX", "1", "PX", "1"}, {"EX"}, {"KEEPTTL", "EX", "1"}, {"FOO"}} {
+		if r := set("v", args...); r != (ErrorReply{ErrSyntax.message}) {
+			t.Errorf("%v: expect syntax error, get %v", args, r)
+		}
+	}
+	if r := set("v", "EX", "0"); r != (ErrorReply{ErrInvalidExpire.message}) {
+		t.Errorf("expect invalid expire, get %v", r)
+	}
+
+	h.Rpush(c, []byte("list"), []byte("a"))
+	if _, err := h.Set(c, []byte("list"), []byte("v"), []byte("GET")); err != ErrWrongType {
+		t.Errorf("expect wrong type, get %v", err)
+	}
+	if r, _ := h.Set(c, []byte("list"), []byte("v"), []byte("NX")); r.(BulkReply).value != nil {
+		t.Errorf("expect nil, get %v", r)
+	}
+}
+
+func TestIncrBy(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+
+	h.Set(c, []byte("n"), []byte("9223372036854775806"))
+	if n, err := h.Incr(c, []byte("n")); n != 9223372036854775807 || err != nil {
+		t.Errorf("expect max int64, get %v, %v", n, err)
+	}
+	if _, err := h.Incr(c, []byte("n")); err != ErrIncrOverflow {
+		t.Errorf("expect overflow, get %v", err)
+	}
+	if v, _ := h.Get(c, []byte("n")); string(v) != "9223372036854775807" {
+		t.Errorf("expect the value kept, get %s", v)
+	}
+
+	h.Set(c, []byte("s"), []byte("abc"))
+	if _, err := h.Incr(c, []byte("s")); err != ErrExpectInteger {
+		t.Errorf("expect not an integer, get %v", err)
+	}
+	if v, _ := h.Get(c, []byte("s")); string(v) != "abc" {
+		t.Errorf("expect nothing written, get %s", v)
+	}
+	h.Hset(c, []byte("h"), []byte("f"), []byte("9223372036854775807"))
+	if _, err := h.Hincrby(c, []byte("h"), []byte("f"), 1); err != ErrIncrOverflow {
+		t.Errorf("expect overflow, get %v", err)
+	}
+	if v, _ := h.Hget(c, []byte("h"), []byte("f")); string(v) != "9223372036854775807" {
+		t.Errorf("expect nothing written, get %s", v)
+	}
+
+	h.Rpush(c, []byte("list"), []byte("a"))
+	if _, err := h.Incr(c, []byte("list")); err != ErrWrongType {
+		t.Errorf("expect wrong type, get %v", err)
+	}
+	if r, _ := h.Lrange(c, []byte("list"), 0, -1); len(r) != 1 {
+		t.Errorf("expect the list untouched, get %q", r)
+	}
+
+	// an expired key of another type is replaced
+	h.Pexpire(c, []byte("list"), 1)
+	time.Sleep(time.Millisecond * 5)
+	if n, err := h.Incrby(c, []byte("list"), 3); n != 3 || err != nil {
+		t.Errorf("expect 3, get %v, %v", n, err)
+	}
+	if n, _ := h.Ttl(c, []byte("list")); n != -1 {
+		t.Errorf("expect no ttl, get %v", n)
+	}
+}
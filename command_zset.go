@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// score of member, ok is false if member does not exist
+func zsetScore(c *redisClient, metaKey, member []byte) (score float64, ok bool, err error) {
+	if v, err := c.db.Get(c.arena, zsetMemberKey(c.arena, metaKey, member)); err != nil || v == nil {
+		return 0, false, err
+	} else {
+		return decodeScore(v), true, nil
+	}
+}
+
+// like scanZset, but does nothing if the zset does not exist
+func scanZsetIfExists(c *redisClient, metaKey []byte, lo, hi scoreBound, reverse bool, fn func(score float64, member []byte) bool) error {
+	if old, err := getMeta(c, metaKey, kTypeZset); err != nil || old == nil {
+		return err
+	}
+	return scanZset(c, metaKey, lo, hi, reverse, fn)
+}
+
+// call fn with every (score, member) between lo and hi, in score order or reversed, until fn returns false
+func scanZset(c *redisClient, metaKey []byte, lo, hi scoreBound, reverse bool, fn func(score float64, member []byte) bool) error {
+	prefix := zsetScorePrefix(c.arena, metaKey)
+	start := zsetScoreKey(c.arena, metaKey, lo.score, nil)
+	if lo.exclusive {
+		start = prefixEnd(start) // skip every member of the min score
+	}
+	limit := zsetScoreKey(c.arena, metaKey, hi.score, nil)
+	if !hi.exclusive {
+		limit = prefixEnd(limit) // include every member of the max score
+	}
+	return c.db.ScanRange(c.arena, start, limit, reverse, func(k, v []byte) bool {
+		sm := k[len(prefix):]
+		return fn(decodeScore(sm), sm[8:])
+	})
+}
+
+type zaddFlags struct {
+	nx, xx, ch, incr bool
+}
+
+// add or update members, returns how many added, how many changed, how many
+// skipped by NX or XX and the last score
+func (h *DbHandler) zadd(c *redisClient, key []byte, flags zaddFlags, scores []float64, members [][]byte) (added, changed, skipped int, score float64, err error) {
+	defer locks.lock(c, key)()
+	defer h.compactView(c)()
+	metaKey := encodeMetaKey(c.arena, key)
+	old, err := getMeta(c, metaKey, kTypeZset)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	zset := SortedSet(old)
+	if old == nil {
+		zset = NewSortedSet(c.arena)
+	}
+
+	ks, vs := make([][]byte, 0, len(members)*3+1), make([][]byte, 0, len(members)*3+1)
+	pending := make(map[string]float64, len(members)) // members updated by this call
+	for i, member := range members {
+		current, exists := pending[string(member)]
+		if !exists && old != nil {
+			if current, exists, err = zsetScore(c, metaKey, member); err != nil {
+				return 0, 0, 0, 0, err
+			}
+		}
+
+		if (flags.nx && exists) || (flags.xx && !exists) {
+			skipped += 1
+			continue
+		}
+		score = scores[i]
+		if flags.incr && exists {
+			if score += current; math.IsNaN(score) { // +inf and -inf
+				return 0, 0, 0, 0, ErrScoreNaN
+			}
+		}
+		if exists && score == current {
+			continue
+		}
+
+		if exists {
+			ks, vs = append(ks, zsetScoreKey(c.arena, metaKey, current, member)), append(vs, nil)
+			changed += 1
+		} else {
+			added += 1
+		}
+		encoded := c.arena.Allocate(8)
+		encodeScore(encoded, score)
+		ks = append(ks, zsetMemberKey(c.arena, metaKey, member), zsetScoreKey(c.arena, metaKey, score, member))
+		vs = append(vs, encoded, []byte{})
+		pending[string(member)] = score
+	}
+
+	if len(ks) == 0 {
+		return 0, 0, skipped, score, nil
+	}
+	zset.setSize(zset.size() + added)
+	ks, vs = append(ks, metaKey), append(vs, zset)
+	return added, changed, skipped, score, c.db.Batch(ks, vs)
+}
+
+// ZADD key [NX|XX] [CH] [INCR] score member [score member ...]
+func (h *DbHandler) Zadd(c *redisClient, key []byte, args ...[]byte) (Reply, error) {
+	flags := zaddFlags{}
+	for len(args) > 0 {
+		switch strings.ToUpper(string(args[0])) {
+		case "NX":
+			flags.nx = true
+		case "XX":
+			flags.xx = true
+		case "CH":
+			flags.ch = true
+		case "INCR":
+			flags.incr = true
+		default:
+			goto pairs
+		}
+		args = args[1:]
+	}
+pairs:
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, ErrSyntax
+	} else if (flags.nx && flags.xx) || (flags.incr && len(args) != 2) {
+		return nil, ErrSyntax
+	}
+
+	scores, members := make([]float64, len(args)/2), make([][]byte, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		if score, err := parseScore(args[i]); err != nil {
+			return nil, err
+		} else {
+			scores[i/2], members[i/2] = score, args[i+1]
+		}
+	}
+
+	added, changed, skipped, score, err := h.zadd(c, key, flags, scores, members)
+	if flags.incr {
+		if skipped > 0 {
+			return BulkReply{nil}, err // aborted by NX or XX
+		}
+		return BulkReply{formatScore(score)}, err
+	} else if flags.ch {
+		return IntReply{added + changed}, err
+	}
+	return IntReply{added}, err
+}
+
+func (h *DbHandler) Zincrby(c *redisClient, key, increment, member []byte) ([]byte, error) {
+	if incr, err := parseScore(increment); err != nil {
+		return nil, err
+	} else {
+		_, _, _, score, err := h.zadd(c, key, zaddFlags{incr: true}, []float64{incr}, [][]byte{member})
+		return formatScore(score), err
+	}
+}
+
+func (h *DbHandler) Zscore(c *redisClient, key, member []byte) ([]byte, error) {
+	defer h.compactView(c)()
+	metaKey := encodeMetaKey(c.arena, key)
+	if old, err := getMeta(c, metaKey, kTypeZset); err != nil || old == nil {
+		return nil, err
+	}
+	if score, ok, err := zsetScore(c, metaKey, member); err != nil || !ok {
+		return nil, err
+	} else {
+		return formatScore(score), nil
+	}
+}
+
+func (h *DbHandler) Zcard(c *redisClient, key []byte) (int, error) {
+	if old, err := getMeta(c, encodeMetaKey(c.arena, key), kTypeZset); err != nil || old == nil {
+		return 0, err
+	} else {
+		return SortedSet(old).size(), nil
+	}
+}
+
+// remove the given members, which should all exist with the given scores, in one batch
+func (h *DbHandler) removeZsetMembers(c *redisClient, metaKey []byte, zset SortedSet, scores []float64, members [][]byte) error {
+	ks, vs := make([][]byte, 0, len(members)*2+1), make([][]byte, 0, len(members)*2+1)
+	for i, member := range members {
+		ks = append(ks, zsetMemberKey(c.arena, metaKey, member), zsetScoreKey(c.arena, metaKey, scores[i], member))
+		vs = append(vs, nil, nil)
+	}
+	if len(members) >= zset.size() {
+		zset = nil // the last member is gone, remove the zset
+	} else {
+		zset.setSize(zset.size() - len(members))
+	}
+	ks, vs = append(ks, metaKey), append(vs, zset)
+	return c.db.Batch(ks, vs)
+}
+
+// replace dst, whatever type it is, with distinct members in one batch, an empty result removes dst
+func (h *DbHandler) storeZset(c *redisClient, dst []byte, scores []float64, members [][]byte) (int, error) {
+	metaKey := encodeMetaKey(c.arena, dst)
+	var ks, vs [][]byte
+	if old, err := getMeta(c, metaKey, 0); err != nil {
+		return 0, err
+	} else if old != nil {
+		if ks, _, err = keyRecords(c, metaKey, old, false); err != nil {
+			return 0, err
+		}
+		vs = make([][]byte, len(ks))
+	}
+
+	zset := NewSortedSet(c.arena)
+	zset.setSize(len(members))
+	if len(members) == 0 {
+		zset = nil
+	}
+	ks, vs = append(ks, metaKey), append(vs, zset)
+	for i, member := range members { // puts come after the deletes, so they win
+		encoded := c.arena.Allocate(8)
+		encodeScore(encoded, scores[i])
+		ks = append(ks, zsetMemberKey(c.arena, metaKey, member), zsetScoreKey(c.arena, metaKey, scores[i], member))
+		vs = append(vs, encoded, []byte{})
+	}
+	return len(members), c.db.Batch(ks, vs)
+}
+
+func (h *DbHandler) Zrem(c *redisClient, key []byte, members ...[]byte) (int, error) {
+	defer locks.lock(c, key)()
+	defer h.compactView(c)()
+	metaKey := encodeMetaKey(c.arena, key)
+	old, err := getMeta(c, metaKey, kTypeZset)
+	if err != nil || old == nil {
+		return 0, err
+	}
+
+	scores, removed := make([]float64, 0, len(members)), make([][]byte, 0, len(members))
+	for _, member := range members {
+		if containsKey(removed, member) {
+			continue
+		}
+		if score, ok, err := zsetScore(c, metaKey, member); err != nil {
+			return 0, err
+		} else if ok {
+			scores, removed = append(scores, score), append(removed, member)
+		}
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+	return len(removed), h.removeZsetMembers(c, metaKey, SortedSet(old), scores, removed)
+}
+
+var allScores = [2]scoreBound{{math.Inf(-1), false}, {math.Inf(1), false}}
+
+func (h *DbHandler) zrank(c *redisClient, key, member []byte, reverse bool) (Reply, error) {
+	defer h.compactView(c)()
+	metaKey := encodeMetaKey(c.arena, key)
+	if old, err := getMeta(c, metaKey, kTypeZset); err != nil || old == nil {
+		return BulkReply{nil}, err
+	}
+	score, ok, err := zsetScore(c, metaKey, member)
+	if err != nil || !ok {
+		return BulkReply{nil}, err
+	}
+
+	rank := 0
+	err = scanZset(c, metaKey, allScores[0], allScores[1], reverse, func(s float64, m []byte) bool {
+		if s == score && bytes.Equal(m, member) {
+			return false
+		}
+		rank += 1
+		return true
+	})
+	return IntReply{rank}, err
+}
+
+// 0 based rank of member by score, nil if it does not exist
+func (h *DbHandler) Zrank(c *redisClient, key, member []byte) (Reply, error) {
+	return h.zrank(c, key, member, false)
+}
+
+// clamp [start, end] to [0, size), ok is false if the range is empty
+func normalizeRange(start, end, size int) (int, int, bool) {
+	if start < 0 {
+		start += size
+	}
+	if end < 0 {
+		end += size
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > end || start >= size {
+		return 0, 0, false
+	}
+	if end >= size {
+		end = size - 1
+	}
+	return start, end, true
+}
+
+func withScores(args [][]byte) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	} else if len(args) == 1 && strings.ToUpper(string(args[0])) == "WITHSCORES" {
+		return true, nil
+	}
+	return false, ErrSyntax
+}
+
+// call fn with members ranked in [start, end], from the highest score if reverse
+func (h *DbHandler) zscanByRank(c *redisClient, metaKey []byte, start, end int, reverse bool, fn func(score float64, member []byte)) error {
+	old, err := getMeta(c, metaKey, kTypeZset)
+	if err != nil || old == nil {
+		return err
+	}
+	start, end, ok := normalizeRange(start, end, SortedSet(old).size())
+	if !ok {
+		return nil
+	}
+
+	i := 0
+	return scanZset(c, metaKey, allScores[0], allScores[1], reverse, func(score float64, member []byte) bool {
+		if i >= start {
+			fn(score, member)
+		}
+		i += 1
+		return i <= end
+	})
+}
+
+func (h *DbHandler) zrange(c *redisClient, key []byte, start, end int, reverse bool, args [][]byte) ([][]byte, error) {
+	defer h.compactView(c)()
+	scores, err := withScores(args)
+	if err != nil {
+		return nil, err
+	}
+	result := make([][]byte, 0)
+	err = h.zscanByRank(c, encodeMetaKey(c.arena, key), start, end, reverse, func(score float64, member []byte) {
+		result = append(result, member)
+		if scores {
+			result = append(result, formatScore(score))
+		}
+	})
+	return result, err
+}
+
+// ZRANGE key start stop [WITHSCORES]
+func (h *DbHandler) Zrange(c *redisClient, key []byte, start, end int, args ...[]byte) ([][]byte, error) {
+	return h.zrange(c, key, start, end, false, args)
+}
+
+// a score bound of ZRANGEBYSCORE: 1.5, (1.5, -inf, +inf
+type scoreBound struct {
+	score     float64
+	exclusive bool
+}
+
+func parseScoreBound(b []byte) (scoreBound, error) {
+	if len(b) > 0 && b[0] == '(' {
+		score, err := parseScore(b[1:])
+		return scoreBound{score, true}, err
+	}
+	score, err := parseScore(b)
+	return scoreBound{score, false}, err
+}
+
+func parseScoreBounds(min, max []byte) (lo, hi scoreBound, err error) {
+	if lo, err = parseScoreBound(min); err == nil {
+		hi, err = parseScoreBound(max)
+	}
+	return
+}
+
+// [WITHSCORES] [LIMIT offset count]
+func parseRangeOptions(args [][]byte) (scores bool, offset, count int, err error) {
+	offset, count = 0, -1
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "WITHSCORES":
+			scores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return false, 0, 0, ErrSyntax
+			}
+			if offset, err = strconv.Atoi(string(args[i+1])); err != nil {
+				return false, 0, 0, ErrExpectInteger
+			}
+			if count, err = strconv.Atoi(string(args[i+2])); err != nil {
+				return false, 0, 0, ErrExpectInteger
+			}
+			i += 2
+		default:
+			return false, 0, 0, ErrSyntax
+		}
+	}
+	return
+}
+
+// a collector honoring LIMIT offset count, stop when count is reached
+func limitCollector(offset, count int, fn func()) func() bool {
+	return func() bool {
+		if offset > 0 {
+			offset -= 1
+			return true
+		}
+		fn()
+		count -= 1
+		return count != 0
+	}
+}
+
+func (h *DbHandler) zrangeByScore(c *redisClient, key []byte, lo, hi scoreBound, reverse bool, args [][]byte) ([][]byte, error) {
+	defer h.compactView(c)()
+	scores, offset, count, err := parseRangeOptions(args)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([][]byte, 0)
+	if offset < 0 || count == 0 {
+		return result, nil
+	}
+	var score float64
+	var member []byte
+	collect := limitCollector(offset, count, func() {
+		result = append(result, member)
+		if scores {
+			result = append(result, formatScore(score))
+		}
+	})
+	err = scanZsetIfExists(c, encodeMetaKey(c.arena, key), lo, hi, reverse, func(s float64, m []byte) bool {
+		score, member = s, m
+		return collect()
+	})
+	return result, err
+}
+
+// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+func (h *DbHandler) Zrangebyscore(c *redisClient, key, min, max []byte, args ...[]byte) ([][]byte, error) {
+	if lo, hi, err := parseScoreBounds(min, max); err != nil {
+		return nil, err
+	} else {
+		return h.zrangeByScore(c, key, lo, hi, false, args)
+	}
+}
+
+// ZREVRANGEBYSCORE key max min [WITHSCORES] [LIMIT offset count]
+func (h *DbHandler) Zrevrangebyscore(c *redisClient, key, max, min []byte, args ...[]byte) ([][]byte, error) {
+	if lo, hi, err := parseScoreBounds(min, max); err != nil {
+		return nil, err
+	} else {
+		return h.zrangeByScore(c, key, lo, hi, true, args)
+	}
+}
+
+// ZREVRANGE key start stop [WITHSCORES]
+func (h *DbHandler) Zrevrange(c *redisClient, key []byte, start, end int, args ...[]byte) ([][]byte, error) {
+	return h.zrange(c, key, start, end, true, args)
+}
+
+func (h *DbHandler) Zcount(c *redisClient, key, min, max []byte) (int, error) {
+	defer h.compactView(c)()
+	lo, hi, err := parseScoreBounds(min, max)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = scanZsetIfExists(c, encodeMetaKey(c.arena, key), lo, hi, false, func(score float64, member []byte) bool {
+		count += 1
+		return true
+	})
+	return count, err
+}
+
+// range of member keys, for the lexicographical bounds: [a, (a, - and +
+func lexRange(prefix, min, max []byte) (start, limit []byte, err error) {
+	bound := func(b []byte, inclusiveEnd bool) ([]byte, error) {
+		if len(b) == 0 {
+			return nil, ErrSyntax
+		}
+		switch {
+		case len(b) == 1 && b[0] == '-':
+			return prefix, nil
+		case len(b) == 1 && b[0] == '+':
+			return prefixEnd(prefix), nil
+		case b[0] != '[' && b[0] != '(':
+			return nil, ErrSyntax
+		}
+		k := append(append(make([]byte, 0, len(prefix)+len(b)), prefix...), b[1:]...)
+		if (b[0] == '[') == inclusiveEnd {
+			k = append(k, 0) // right after the member itself
+		}
+		return k, nil
+	}
+	if start, err = bound(min, false); err == nil {
+		limit, err = bound(max, true)
+	}
+	return
+}
+
+// ZRANGEBYLEX key min max [LIMIT offset count], for members with the same score
+func (h *DbHandler) Zrangebylex(c *redisClient, key, min, max []byte, args ...[]byte) ([][]byte, error) {
+	defer h.compactView(c)()
+	scores, offset, count, err := parseRangeOptions(args)
+	if err != nil || scores {
+		return nil, ErrSyntax
+	}
+	metaKey := encodeMetaKey(c.arena, key)
+	prefix := zsetMemberKey(c.arena, metaKey, nil)
+	start, limit, err := lexRange(prefix, min, max)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([][]byte, 0)
+	if offset < 0 || count == 0 {
+		return result, nil
+	}
+	if old, err := getMeta(c, metaKey, kTypeZset); err != nil || old == nil {
+		return result, err
+	}
+	var member []byte
+	collect := limitCollector(offset, count, func() {
+		result = append(result, member)
+	})
+	// member => score keys are ordered by member
+	err = c.db.ScanRange(c.arena, start, limit, false, func(k, v []byte) bool {
+		member = k[len(prefix):]
+		return collect()
+	})
+	return result, err
+}
+
+func (h *DbHandler) zremRange(c *redisClient, metaKey []byte, scores []float64, members [][]byte) (int, error) {
+	if len(members) == 0 {
+		return 0, nil
+	}
+	if old, err := getMeta(c, metaKey, kTypeZset); err != nil || old == nil {
+		return 0, err
+	} else {
+		return len(members), h.removeZsetMembers(c, metaKey, SortedSet(old), scores, members)
+	}
+}
+
+func (h *DbHandler) Zremrangebyscore(c *redisClient, key, min, max []byte) (int, error) {
+	defer locks.lock(c, key)()
+	defer h.compactView(c)()
+	lo, hi, err := parseScoreBounds(min, max)
+	if err != nil {
+		return 0, err
+	}
+	metaKey := encodeMetaKey(c.arena, key)
+	scores, members := make([]float64, 0), make([][]byte, 0)
+	err = scanZsetIfExists(c, metaKey, lo, hi, false, func(score float64, member []byte) bool {
+		scores, members = append(scores, score), append(members, member)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return h.zremRange(c, metaKey, scores, members)
+}
+
+func (h *DbHandler) Zremrangebyrank(c *redisClient, key []byte, start, end int) (int, error) {
+	defer locks.lock(c, key)()
+	defer h.compactView(c)()
+	metaKey := encodeMetaKey(c.arena, key)
+	scores, members := make([]float64, 0), make([][]byte, 0)
+	err := h.zscanByRank(c, metaKey, start, end, false, func(score float64, member []byte) {
+		scores, members = append(scores, score), append(members, member)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return h.zremRange(c, metaKey, scores, members)
+}
+
+// ZSCAN key cursor [MATCH pattern] [COUNT count], members come in member order
+func (h *DbHandler) Zscan(c *redisClient, key, cursor []byte, args ...[]byte) (Reply, error) {
+	defer h.compactView(c)()
+	return scanCollection(c, key, kTypeZset, kZsetMemberKeyPrefix, cursor, args,
+		func(out [][]byte, member, score []byte) [][]byte {
+			return append(out, member, formatScore(decodeScore(score)))
+		})
+}
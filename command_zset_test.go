@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestZsetCommands(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+
+	key := []byte("board")
+	args := [][]byte{[]byte("3"), []byte("c"), []byte("-1.5"), []byte("a"), []byte("2"), []byte("b"), []byte("10"), []byte("d")}
+	if n, err := h.Zadd(c, key, args...); n != (IntReply{4}) || err != nil {
+		t.Errorf("expect 4 members added, get %v, %v", n, err)
+	}
+	if n, _ := h.Zadd(c, key, []byte("CH"), []byte("5"), []byte("c"), []byte("2"), []byte("b")); n != (IntReply{1}) {
+		t.Errorf("expect 1 member changed, get %v", n)
+	}
+	if v, _ := h.Zincrby(c, key, []byte("0.5"), []byte("a")); string(v) != "-1" {
+		t.Errorf("expect -1, get %s", v)
+	}
+	if v, _ := h.Zscore(c, key, []byte("c")); string(v) != "5" {
+		t.Errorf("expect 5, get %s", v)
+	}
+	h.Zadd(c, []byte("inf"), []byte("+inf"), []byte("a"))
+	if _, err := h.Zadd(c, []byte("inf"), []byte("INCR"), []byte("-inf"), []byte("a")); err != ErrScoreNaN {
+		t.Errorf("expect NaN error, get %v", err)
+	}
+	if v, _ := h.Zscore(c, []byte("inf"), []byte("a")); string(v) != string(formatScore(math.Inf(1))) {
+		t.Errorf("expect inf kept, get %s", v)
+	}
+	// INCR replies the score unless NX or XX skipped the member
+	if v, _ := h.Zadd(c, key, []byte("XX"), []byte("INCR"), []byte("0"), []byte("c")); string(v.(BulkReply).value) != "5" {
+		t.Errorf("expect 5, get %v", v)
+	}
+	if v, _ := h.Zadd(c, key, []byte("INCR"), []byte("-0"), []byte("c")); string(v.(BulkReply).value) != "5" {
+		t.Errorf("expect 5, get %v", v)
+	}
+	if v, _ := h.Zadd(c, key, []byte("NX"), []byte("INCR"), []byte("1"), []byte("c")); v.(BulkReply).value != nil {
+		t.Errorf("expect nil, get %v", v)
+	}
+	if n, _ := h.Zrank(c, key, []byte("c")); n != (IntReply{2}) {
+		t.Errorf("expect rank 2, get %v", n)
+	}
+
+	if r, _ := h.Zrange(c, key, 1, -1, []byte("withscores")); len(r) != 6 || string(r[0]) != "b" || string(r[5]) != "10" {
+		t.Errorf("expect b 2 c 5 d 10, get %q", r)
+	}
+	if r, _ := h.Zrangebyscore(c, key, []byte("(2"), []byte("+inf")); len(r) != 2 || string(r[0]) != "c" {
+		t.Errorf("expect c d, get %q", r)
+	}
+	if r, _ := h.Zrangebyscore(c, key, []byte("-inf"), []byte("5"), []byte("LIMIT"), []byte("1"), []byte("1")); len(r) != 1 || string(r[0]) != "b" {
+		t.Errorf("expect b, get %q", r)
+	}
+
+	if n, _ := h.Zrem(c, key, []byte("a"), []byte("a"), []byte("x")); n != 1 {
+		t.Errorf("expect 1 member removed, get %v", n)
+	}
+	if n, _ := h.Zcard(c, key); n != 3 {
+		t.Errorf("expect 3 members, get %v", n)
+	}
+	if r, _ := h.Zrange(c, key, 0, 0); len(r) != 1 || string(r[0]) != "b" {
+		t.Errorf("expect b, get %q", r)
+	}
+}
+
+func TestZsetRangeCommands(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+
+	key := []byte("feed")
+	h.Zadd(c, key, []byte("1"), []byte("a"), []byte("2"), []byte("b"), []byte("2"), []byte("c"), []byte("3"), []byte("d"))
+	// a neighbour key should never show up
+	h.Zadd(c, []byte("feed2"), []byte("2"), []byte("x"))
+
+	if r, _ := h.Zrevrange(c, key, 0, 1, []byte("WITHSCORES")); len(r) != 4 || string(r[0]) != "d" || string(r[2]) != "c" {
+		t.Errorf("expect d 3 c 2, get %q", r)
+	}
+	if r, _ := h.Zrevrangebyscore(c, key, []byte("2"), []byte("-inf")); len(r) != 3 || string(r[0]) != "c" {
+		t.Errorf("expect c b a, get %q", r)
+	}
+	if r, _ := h.Zrevrangebyscore(c, key, []byte("+inf"), []byte("(1"), []byte("LIMIT"), []byte("1"), []byte("2")); len(r) != 2 || string(r[0]) != "c" {
+		t.Errorf("expect c b, get %q", r)
+	}
+	if n, _ := h.Zcount(c, key, []byte("(1"), []byte("2")); n != 2 {
+		t.Errorf("expect 2, get %v", n)
+	}
+	if r, _ := h.Zrangebylex(c, key, []byte("(a"), []byte("[c")); len(r) != 2 || string(r[0]) != "b" {
+		t.Errorf("expect b c, get %q", r)
+	}
+	if r, _ := h.Zrangebylex(c, key, []byte("-"), []byte("+"), []byte("LIMIT"), []byte("3"), []byte("5")); len(r) != 1 || string(r[0]) != "d" {
+		t.Errorf("expect d, get %q", r)
+	}
+
+	if n, _ := h.Zremrangebyscore(c, key, []byte("2"), []byte("2")); n != 2 {
+		t.Errorf("expect 2 removed, get %v", n)
+	}
+	if n, _ := h.Zremrangebyrank(c, key, -1, -1); n != 1 {
+		t.Errorf("expect 1 removed, get %v", n)
+	}
+	if r, _ := h.Zrange(c, key, 0, -1); len(r) != 1 || string(r[0]) != "a" {
+		t.Errorf("expect a, get %q", r)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Small hashes, sets and zsets are saved compact: the members follow the meta,
+// each as uvarint length + member, uvarint length + value, and there are no
+// member keys. A zset packs member => score only, the score index is rebuilt
+// when it's read. Commands see a compact key through a compactStore, as if it
+// had member keys. Once it grows too big, it's saved as member keys for good.
+const (
+	kCollectionMetaSize = 12  // count, add-ts, update-ts
+	kMaxCompactValue    = 64  // a longer member or value makes member keys, unless configured
+	kMaxCompactEntries  = 128 // unless configured
+)
+
+// a hash, set or zset whose members are packed in the meta
+func compactMeta(meta []byte) bool {
+	switch metaType(meta) {
+	case kTypeHash, kTypeSet, kTypeZset:
+		return len(meta) > kMetaHeaderSize+kCollectionMetaSize
+	}
+	return false
+}
+
+// the member key prefix which is packed, for a hash, set or zset
+func compactPrefix(typ byte) byte {
+	switch typ {
+	case kTypeHash:
+		return kHashFieldKeyPrefix
+	case kTypeSet:
+		return kSetMemberKeyPrefix
+	}
+	return kZsetMemberKeyPrefix
+}
+
+// how many elements a list may have to be saved inline, or a hash, set or zset to be compact
+func (h *DbHandler) maxCompactEntries(typ byte) int {
+	n := 0
+	if h.server != nil {
+		switch conf := h.server.conf; typ {
+		case kTypeList:
+			n = conf.ListMaxZiplistEntries
+		case kTypeHash:
+			n = conf.HashMaxZiplistEntries
+		case kTypeSet:
+			n = conf.SetMaxZiplistEntries
+		case kTypeZset:
+			n = conf.ZsetMaxZiplistEntries
+		}
+	}
+	if n <= 0 {
+		return kMaxCompactEntries
+	}
+	return n
+}
+
+// how long an element of a list saved inline, or a member or value of a compact key may be
+func (h *DbHandler) maxCompactValue(typ byte) int {
+	n := 0
+	if h.server != nil {
+		switch conf := h.server.conf; typ {
+		case kTypeList:
+			n = conf.ListMaxZiplistValue
+		case kTypeHash:
+			n = conf.HashMaxZiplistValue
+		case kTypeSet:
+			n = conf.SetMaxZiplistValue
+		case kTypeZset:
+			n = conf.ZsetMaxZiplistValue
+		}
+	}
+	if n <= 0 {
+		return kMaxCompactValue
+	}
+	return n
+}
+
+func packMembers(a *Arena, meta []byte, members, values [][]byte) []byte {
+	size := kMetaHeaderSize + kCollectionMetaSize
+	for i := range members {
+		size += uvarintSize(len(members[i])) + len(members[i]) + uvarintSize(len(values[i])) + len(values[i])
+	}
+	packed := a.Allocate(size)
+	off := copy(packed, meta[:kMetaHeaderSize+kCollectionMetaSize])
+	for i := range members {
+		off += binary.PutUvarint(packed[off:], uint64(len(members[i])))
+		off += copy(packed[off:], members[i])
+		off += binary.PutUvarint(packed[off:], uint64(len(values[i])))
+		off += copy(packed[off:], values[i])
+	}
+	return packed
+}
+
+func unpackMembers(meta []byte, fn func(member, value []byte)) {
+	next := func(b []byte) ([]byte, []byte) {
+		n, size := binary.Uvarint(b)
+		end := size + int(n)
+		return b[size:end:end], b[end:]
+	}
+	for b := meta[kMetaHeaderSize+kCollectionMetaSize:]; len(b) > 0; {
+		var member, value []byte
+		member, b = next(b)
+		value, b = next(b)
+		fn(member, value)
+	}
+}
+
+// A view of db where compact keys are expanded to member keys, in memory,
+// when their meta is read. Writes to them are packed back right away, writes
+// to other keys go to db as they are.
+type compactStore struct {
+	*txStore
+	h       *DbHandler
+	managed map[string]bool // by key, whose meta is read: saved compact, or new
+}
+
+// c reads and writes through a compactStore, till the returned func is called
+func (h *DbHandler) compactView(c *redisClient) (restore func()) {
+	if _, ok := c.db.(*compactStore); ok {
+		return func() {} // a helper of a command which has one
+	}
+	db := c.db
+	c.db = &compactStore{
+		txStore: &txStore{db: db, writes: make(map[string][]byte)},
+		h:       h,
+		managed: make(map[string]bool),
+	}
+	return func() { c.db = db }
+}
+
+// Read the meta of key. If it's compact, or a string or nothing, which may
+// become a new compact key, the key is managed by the view from now on.
+// Lists and the keys saved as member keys are left alone.
+func (s *compactStore) expand(key []byte) error {
+	a := NewArena(0)
+	mKey := encodeMetaKey(a, key)
+	meta, err := s.db.Get(a, mKey)
+	if err != nil {
+		return err
+	} else if meta != nil && len(meta) < kMetaHeaderSize {
+		return ErrInvalidMeta
+	}
+	if meta != nil && metaType(meta) != kTypeString && !compactMeta(meta) {
+		s.managed[string(key)] = false
+		return nil
+	}
+	s.managed[string(key)] = true
+	if meta == nil {
+		return nil
+	} else if !compactMeta(meta) {
+		s.writes[string(mKey)] = meta
+		return nil
+	}
+
+	s.writes[string(mKey)] = meta[:kMetaHeaderSize+kCollectionMetaSize]
+	prefix := compactPrefix(metaType(meta))
+	unpackMembers(meta, func(member, value []byte) {
+		s.writes[string(memberKey(a, prefix, mKey, member))] = value
+		if prefix == kZsetMemberKeyPrefix {
+			s.writes[string(zsetScoreKey(a, mKey, decodeScore(value), member))] = []byte{}
+		}
+	})
+	return nil
+}
+
+func (s *compactStore) Get(a *Arena, key []byte) ([]byte, error) {
+	if k := logicalKey(key); k != nil {
+		managed, seen := s.managed[string(k)]
+		if !seen {
+			if err := s.expand(k); err != nil {
+				return nil, err
+			}
+			managed = s.managed[string(k)]
+		}
+		if _, ok := s.writes[string(key)]; managed && !ok {
+			return nil, nil // all it has is in memory
+		}
+	}
+	return s.txStore.Get(a, key)
+}
+
+func (s *compactStore) Set(key, value []byte) error {
+	return s.Batch([][]byte{key}, [][]byte{value})
+}
+
+func (s *compactStore) Delete(key []byte) error {
+	return s.Batch([][]byte{key}, [][]byte{nil})
+}
+
+func (s *compactStore) Batch(ks, vs [][]byte) error {
+	var dks, dvs [][]byte // to db
+	var packing [][]byte
+	for i, k := range ks {
+		if key := logicalKey(k); key != nil && s.managed[string(key)] {
+			s.txStore.Batch(ks[i:i+1], vs[i:i+1])
+			if !containsKey(packing, key) {
+				packing = append(packing, key)
+			}
+		} else {
+			dks, dvs = append(dks, k), append(dvs, vs[i])
+		}
+	}
+	for _, key := range packing {
+		pks, pvs, err := s.pack(key)
+		if err != nil {
+			return err
+		}
+		dks, dvs = append(dks, pks...), append(dvs, pvs...)
+	}
+	if len(dks) == 0 {
+		return nil
+	}
+	return s.db.Batch(dks, dvs)
+}
+
+// the records which save the managed key as it is in memory: the meta with
+// the members packed, or the meta and member keys if there are too many
+func (s *compactStore) pack(key []byte) (ks, vs [][]byte, err error) {
+	a := NewArena(0)
+	mKey := encodeMetaKey(a, key)
+	meta, err := s.txStore.Get(a, mKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case meta == nil:
+		return [][]byte{mKey}, [][]byte{nil}, nil
+	case metaType(meta) != kTypeHash && metaType(meta) != kTypeSet && metaType(meta) != kTypeZset:
+		return [][]byte{mKey}, [][]byte{meta}, nil
+	}
+	meta = meta[:kMetaHeaderSize+kCollectionMetaSize]
+
+	prefix := memberKey(a, compactPrefix(metaType(meta)), mKey, nil)
+	fit, maxValue := true, s.h.maxCompactValue(metaType(meta))
+	var members, values [][]byte
+	err = s.txStore.ScanRange(a, prefix, prefixEnd(prefix), false, func(k, v []byte) bool {
+		member := k[len(prefix):]
+		members, values = append(members, member), append(values, v)
+		fit = fit && len(member) <= maxValue && len(v) <= maxValue
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if fit && len(members) <= s.h.maxCompactEntries(metaType(meta)) {
+		return [][]byte{mKey}, [][]byte{packMembers(a, meta, members, values)}, nil
+	}
+
+	// from now on, db has the member keys
+	ks, vs = [][]byte{mKey}, [][]byte{meta}
+	prefixes := [][]byte{prefix}
+	if metaType(meta) == kTypeZset {
+		prefixes = append(prefixes, zsetScorePrefix(a, mKey))
+	}
+	for _, p := range prefixes {
+		err = s.txStore.ScanRange(a, p, prefixEnd(p), false, func(k, v []byte) bool {
+			ks, vs = append(ks, k), append(vs, v)
+			return true
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	for k := range s.writes {
+		if bytes.Equal(logicalKey([]byte(k)), key) {
+			delete(s.writes, k)
+		}
+	}
+	s.managed[string(key)] = false
+	return ks, vs, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+// member keys of every hash, set and zset in db
+func memberKeys(c *redisClient) int {
+	n := 0
+	for _, p := range []byte{kHashFieldKeyPrefix, kSetMemberKeyPrefix, kZsetMemberKeyPrefix, kZsetScoreKeyPrefix} {
+		ks, _, _ := scanRecords(c, []byte{p}, false, nil, nil)
+		n += len(ks)
+	}
+	return n
+}
+
+func TestCompactCollections(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+	conf := &RockRedisConf{HashMaxZiplistEntries: 3, SetMaxZiplistEntries: 3, ZsetMaxZiplistEntries: 3}
+	h.server = &Server{conf: conf, blocked: newBlockedClients()}
+	args := func(s string) [][]byte {
+		return bytes.Fields([]byte(s))
+	}
+
+	h.Hset(c, []byte("h"), args("a 1 b 2")...)
+	h.Sadd(c, []byte("s"), args("x y")...)
+	h.Zadd(c, []byte("z"), args("2 b 1 a")...)
+	h.Expire(c, []byte("h"), 100)
+	if n := memberKeys(c); n != 0 {
+		t.Errorf("expect all compact, get %d member keys", n)
+	}
+	if n, _ := h.Hincrby(c, []byte("h"), []byte("b"), 3); n != 5 {
+		t.Errorf("expect 5, get %v", n)
+	}
+	if r, _ := h.Hgetall(c, []byte("h")); string(bytes.Join(r, nil)) != "a1b5" {
+		t.Errorf("expect a 1 b 5, get %q", r)
+	}
+	if n, _ := h.Sismember(c, []byte("s"), []byte("y")); n != 1 {
+		t.Errorf("expect y a member, get %v", n)
+	}
+	if r, _ := h.Zrange(c, []byte("z"), 0, -1, []byte("WITHSCORES")); string(bytes.Join(r, nil)) != "a1b2" {
+		t.Errorf("expect a 1 b 2, get %q", r)
+	}
+	if n, _ := h.Sinterstore(c, []byte("dst"), []byte("s"), []byte("s")); n != 2 || memberKeys(c) != 0 {
+		t.Errorf("expect a compact set of 2, get %v, %d member keys", n, memberKeys(c))
+	}
+
+	// past the thresholds, member keys from now on
+	h.Hset(c, []byte("h"), args("c 3 d 4")...)
+	h.Sadd(c, []byte("s"), bytes.Repeat([]byte("v"), kMaxCompactValue+1))
+	h.Zadd(c, []byte("z"), args("3 c 4 d")...)
+	if n := memberKeys(c); n != 4+3+4*2 {
+		t.Errorf("expect %d member keys, get %d", 4+3+4*2, n)
+	}
+	if ttl, _ := h.Ttl(c, []byte("h")); ttl <= 0 {
+		t.Errorf("expect the ttl kept, get %v", ttl)
+	}
+	if r, _ := h.Zrangebyscore(c, []byte("z"), []byte("2"), []byte("+inf")); string(bytes.Join(r, nil)) != "bcd" {
+		t.Errorf("expect b c d, get %q", r)
+	}
+	h.Zrem(c, []byte("z"), args("a b c")...) // stays as member keys
+	if n := memberKeys(c); n != 4+3+1*2 {
+		t.Errorf("expect %d member keys, get %d", 4+3+1*2, n)
+	}
+
+	for i := 0; i < 3; i++ {
+		h.Sadd(c, []byte("gone"), []byte(strconv.Itoa(i)))
+	}
+	if n, _ := h.Del(c, []byte("gone"), []byte("dst"), []byte("h")); n != 3 {
+		t.Errorf("expect 3 deleted, get %v", n)
+	}
+	if r, _ := h.Smembers(c, []byte("gone")); len(r) != 0 {
+		t.Errorf("expect gone, get %q", r)
+	}
+	if n := memberKeys(c); n != 3+1*2 {
+		t.Errorf("expect %d member keys, get %d", 3+1*2, n)
+	}
+}
+
+func TestCompactValueConfig(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+	conf := &RockRedisConf{HashMaxZiplistValue: 4, ListMaxZiplistValue: 4}
+	h.server = &Server{conf: conf, blocked: newBlockedClients()}
+
+	h.Hset(c, []byte("h"), []byte("f"), []byte("1234"))
+	if n := memberKeys(c); n != 0 {
+		t.Errorf("expect a compact hash, get %d member keys", n)
+	}
+	h.Hset(c, []byte("h"), []byte("g"), []byte("12345"))
+	if n := memberKeys(c); n != 2 {
+		t.Errorf("expect 2 member keys, get %d", n)
+	}
+
+	h.Rpush(c, []byte("l"), []byte("1234"))
+	if ks, _, _ := scanRecords(c, []byte{kListDataKeyPrefix}, false, nil, nil); len(ks) != 0 {
+		t.Errorf("expect an inline list, get %d data keys", len(ks))
+	}
+	h.Rpush(c, []byte("l"), []byte("12345"))
+	if ks, _, _ := scanRecords(c, []byte{kListDataKeyPrefix}, false, nil, nil); len(ks) != 2 {
+		t.Errorf("expect 2 data keys, get %d", len(ks))
+	}
+}
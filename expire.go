@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"time"
+)
+
+// Every key has a meta record: k + key, its value starts with a header:
+// type and expire-at, in unix milliseconds, 0 if the key never expires.
+// The rest is the string value, or the meta of the list, hash, set or zset.
+// Keys with a timeout also get an entry in the expire index:
+// x + expire-at + meta key, which the sweeper walks in time order.
+const (
+	kMetaHeaderSize  = 9
+	kExpireKeyPrefix = 'x'
+
+	sweepInterval = time.Millisecond * 100
+	sweepBatch    = 1024 // keys deleted per db per round
+)
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// a meta value of type typ which never expires, followed by size bytes for the type
+func newMeta(a *Arena, typ byte, size int) []byte {
+	meta := a.Allocate(kMetaHeaderSize + size)
+	meta[0] = typ
+	bigEndian.PutUint64(meta[1:], 0) // expire-at, the arena may hand out used memory
+	return meta
+}
+
+func metaType(meta []byte) byte {
+	return meta[0]
+}
+
+// element count of a list, hash, set or zset, which all keep it right after the header
+func metaSize(meta []byte) int {
+	return int(bigEndian.Uint32(meta[kMetaHeaderSize:]))
+}
+
+func metaExpireAt(meta []byte) int64 {
+	return int64(bigEndian.Uint64(meta[1:]))
+}
+
+func setMetaExpireAt(meta []byte, at int64) {
+	bigEndian.PutUint64(meta[1:], uint64(at))
+}
+
+func metaExpired(meta []byte, now int64) bool {
+	at := metaExpireAt(meta)
+	return at != 0 && at <= now
+}
+
+func encodeMetaKey(a *Arena, key []byte) []byte {
+	mKey := a.Allocate(len(key) + 1)
+	mKey[0] = kMetaKeyPrefix
+	copy(mKey[1:], key)
+	return mKey
+}
+
+func expireIndexKey(a *Arena, at int64, mKey []byte) []byte {
+	k := a.Allocate(1 + 8 + len(mKey))
+	k[0] = kExpireKeyPrefix
+	bigEndian.PutUint64(k[1:], uint64(at))
+	copy(k[9:], mKey)
+	return k
+}
+
+// the meta value of mKey, nil if it does not exist, ErrWrongType if it is
+// not of type typ, 0 for any type. An expired key is deleted on the spot,
+// together with all its data keys, if c holds its lock. Otherwise a writer
+// may be replacing it, it's left for the sweeper
+func getMeta(c *redisClient, mKey []byte, typ byte) ([]byte, error) {
+	meta, err := c.db.Get(c.arena, mKey)
+	if err != nil {
+		return nil, err
+	} else if meta == nil {
+		if locks.holds(c, mKey[1:]) { // a writer, which may create the key again
+			unlinking.wait(c.db, mKey) // data keys of the old key may be on the way out
+		}
+		return nil, nil
+	} else if len(meta) < kMetaHeaderSize {
+		return nil, ErrInvalidMeta
+	}
+	if metaExpired(meta, nowMs()) {
+		if locks.holds(c, mKey[1:]) {
+			return nil, deleteKey(c, mKey, meta)
+		}
+		return nil, nil
+	}
+	if typ != 0 && metaType(meta) != typ {
+		return nil, ErrWrongType
+	}
+	return meta, nil
+}
+
+// find key whatever type it is, mKey is nil if it does not exist
+func findKey(c *redisClient, key []byte) (mKey, meta []byte, err error) {
+	mKey = encodeMetaKey(c.arena, key)
+	if meta, err = getMeta(c, mKey, 0); err != nil || meta == nil {
+		return nil, nil, err
+	}
+	return mKey, meta, nil
+}
+
+// every key under prefix, and its value if values is true
+func scanRecords(c *redisClient, prefix []byte, values bool, ks, vs [][]byte) ([][]byte, [][]byte, error) {
+	err := c.db.Scan(c.arena, prefix, func(k, v []byte) bool {
+		if !bytes.HasPrefix(k, prefix) {
+			return false
+		}
+		ks = append(ks, k)
+		if values {
+			vs = append(vs, v)
+		}
+		return true
+	})
+	return ks, vs, err
+}
+
+// the meta key and all data keys of a key, with their values if values is true
+func keyRecords(c *redisClient, mKey, meta []byte, values bool) (ks, vs [][]byte, err error) {
+	ks, vs = [][]byte{mKey}, [][]byte{meta}
+	if compactMeta(meta) {
+		return ks, vs, nil // the members are in the meta
+	}
+	switch metaType(meta) {
+	case kTypeList:
+		llen, minseq := LinkedList(meta).listMeta()
+		if LinkedList(meta).inline() {
+			break // the elements are in the meta
+		}
+		for i := 0; i < llen && err == nil; i++ {
+			dKey := listDataKey(c.arena, mKey, minseq+i)
+			ks = append(ks, dKey)
+			if values {
+				var v []byte
+				v, err = c.db.Get(c.arena, dKey)
+				vs = append(vs, v)
+			}
+		}
+	case kTypeHash:
+		ks, vs, err = scanRecords(c, hashFieldKey(c.arena, mKey, nil), values, ks, vs)
+	case kTypeSet:
+		ks, vs, err = scanRecords(c, setMemberKey(c.arena, mKey, nil), values, ks, vs)
+	case kTypeZset:
+		if ks, vs, err = scanRecords(c, zsetMemberKey(c.arena, mKey, nil), values, ks, vs); err == nil {
+			ks, vs, err = scanRecords(c, zsetScorePrefix(c.arena, mKey), values, ks, vs)
+		}
+	case kTypeBitmap:
+		ks, vs, err = scanRecords(c, memberKey(c.arena, kBitmapPageKeyPrefix, mKey, nil), values, ks, vs)
+	}
+	return ks, vs, err
+}
+
+// delete the meta key and all data keys in one batch
+func deleteKey(c *redisClient, mKey, meta []byte) error {
+	if metaType(meta) == kTypeString {
+		return c.db.Delete(mKey)
+	}
+	ks, _, err := keyRecords(c, mKey, meta, false)
+	if err != nil {
+		return err
+	}
+	return c.db.Batch(ks, make([][]byte, len(ks)))
+}
+
+// set the expire-at of mKey, and index it for the sweeper
+func expireKey(c *redisClient, mKey, meta []byte, at int64) error {
+	setMetaExpireAt(meta, at)
+	ks, vs := createKvs(2)
+	ks[0], vs[0] = mKey, meta
+	ks[1], vs[1] = expireIndexKey(c.arena, at, mKey), []byte{}
+	return c.db.Batch(ks, vs)
+}
+
+// delete up to limit keys whose time is up, return how many index entries are processed
+func sweepExpired(c *redisClient, limit int) (int, error) {
+	now := nowMs()
+	prefix := []byte{kExpireKeyPrefix}
+	ks := make([][]byte, 0, 64)
+	err := c.db.ScanRange(c.arena, prefix, expireIndexKey(c.arena, now+1, nil), false, func(k, v []byte) bool {
+		ks = append(ks, k)
+		return len(ks) < limit
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, k := range ks {
+		at, mKey := int64(bigEndian.Uint64(k[1:])), k[9:]
+		if err := sweepKey(c, mKey, at, now); err != nil {
+			return 0, err
+		}
+		if err := c.db.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	return len(ks), nil
+}
+
+// The index is never updated in place: PERSIST or SET leave the entry behind,
+// only delete the key if it still expires at this time
+func sweepKey(c *redisClient, mKey []byte, at, now int64) error {
+	defer locks.lock(c, mKey[1:])()
+	if meta, err := c.db.Get(c.arena, mKey); err != nil {
+		return err
+	} else if len(meta) >= kMetaHeaderSize && metaExpireAt(meta) == at && metaExpired(meta, now) {
+		return deleteKey(c, mKey, meta)
+	}
+	return nil
+}
+
+// background sweeper, reclaim disk space of expired keys nobody reads again
+func (s *Server) sweep() {
+	c := &redisClient{arena: NewArena(1024 * 32)}
+	for s.shutdown.Get() == 0 {
+		busy := false
+		for i := 0; i < s.conf.Databases; i++ {
+			c.db = s.db(i)
+			if n, err := sweepExpired(c, sweepBatch); err != nil {
+				log.Printf("Sweep expired keys of db %v, get error: %v", i, err)
+			} else if n == sweepBatch {
+				busy = true
+			}
+			c.arena.Reset()
+		}
+		if !busy {
+			time.Sleep(sweepInterval)
+		}
+	}
+}
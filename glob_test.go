@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "aXbY", false},
+	}
+	for _, c := range cases {
+		if globMatch([]byte(c.pattern), []byte(c.s)) != c.match {
+			t.Errorf("%q matches %q should be %v", c.pattern, c.s, c.match)
+		}
+	}
+}
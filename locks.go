@@ -0,0 +1,60 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+const lockStripes = 1024
+
+// Read-modify-write commands hold the lock of the keys they touch. Keys are
+// hashed onto a fixed set of mutexes, two keys may share one.
+type keyLocks [lockStripes]sync.Mutex
+
+var locks = &keyLocks{}
+
+func lockStripe(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % lockStripes)
+}
+
+// Lock every key for c. Stripes are taken in order so that two clients never
+// deadlock, a command locks all its keys in one call. Stripes c holds are
+// skipped, a helper may lock the key its caller locked.
+func (l *keyLocks) lock(c *redisClient, keys ...[]byte) (unlock func()) {
+	stripes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		stripes = append(stripes, lockStripe(key))
+	}
+	sort.Ints(stripes)
+	held := stripes[:0]
+	for i, s := range stripes {
+		if (i == 0 || s != stripes[i-1]) && !c.holdsStripe(s) {
+			l[s].Lock()
+			held = append(held, s)
+		}
+	}
+	c.locked = append(c.locked, held...)
+	return func() {
+		for _, s := range held {
+			l[s].Unlock()
+		}
+		c.locked = c.locked[:len(c.locked)-len(held)]
+	}
+}
+
+// whether c holds the lock of key
+func (l *keyLocks) holds(c *redisClient, key []byte) bool {
+	return c.holdsStripe(lockStripe(key))
+}
+
+func (c *redisClient) holdsStripe(s int) bool {
+	for _, held := range c.locked {
+		if held == s {
+			return true
+		}
+	}
+	return false
+}
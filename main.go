@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -21,9 +22,21 @@ const (
 	ScheduleShutDown = 1 // receive signal, schedule shutdown
 	CloseCalled      = 2 // close callded
 
-	kStringKeyPrefix   = 's'
-	kListKeyPrefix     = 'l'
-	kListDataKeyPrefix = 'd'
+	kMetaKeyPrefix       = 'k' // one per key, whatever type it is
+	kListDataKeyPrefix   = 'd'
+	kHashFieldKeyPrefix  = 'f'
+	kSetMemberKeyPrefix  = 'm'
+	kZsetMemberKeyPrefix = 'r' // member => score
+	kZsetScoreKeyPrefix  = 'i' // score + member, ordered by score
+	kBitmapPageKeyPrefix = 'p' // page index => a page of a long bitmap
+
+	// the first byte of the meta value
+	kTypeString = 's'
+	kTypeList   = 'l'
+	kTypeHash   = 'h'
+	kTypeSet    = 'e'
+	kTypeZset   = 'z'
+	kTypeBitmap = 'b' // a string saved in pages, by the bit commands
 )
 
 type HandlerFn func(client *redisClient, req *Request) (Reply, error)
@@ -39,13 +52,24 @@ type RockRedisConf struct {
 	Cache       int
 
 	// How many list element saved inline
-//	ListMaxZiplistEntries int
+	ListMaxZiplistEntries int `cfg:"optional"`
+	// How many members a hash, set or zset may have to be saved compact
+	HashMaxZiplistEntries int `cfg:"optional"`
+	SetMaxZiplistEntries  int `cfg:"optional"`
+	ZsetMaxZiplistEntries int `cfg:"optional"`
+	// How long each of them may be
+	ListMaxZiplistValue int `cfg:"optional"`
+	HashMaxZiplistValue int `cfg:"optional"`
+	SetMaxZiplistValue  int `cfg:"optional"`
+	ZsetMaxZiplistValue int `cfg:"optional"`
 }
 
 type Store interface {
 	Get(a *Arena, key []byte) ([]byte, error)
 	Set(key, value []byte) error
 	Scan(a *Arena, start []byte, collector func(key, val []byte) bool) error
+	// keys in [start, limit), nil limit for no upper bound. Reverse begins with the last key
+	ScanRange(a *Arena, start, limit []byte, reverse bool, collector func(key, val []byte) bool) error
 	Batch(ks, vs [][]byte) error
 	Delete(key []byte) error
 	Close() error
@@ -60,6 +84,9 @@ type Server struct {
 	conf     *RockRedisConf
 	handlers map[string]HandlerFn
 	dbs      []Store
+	dirs     []string     // dbs[i] is opened from dirs[i], SWAPDB swaps both
+	dbsLock  sync.RWMutex // guard dbs and dirs
+	blocked  *blockedClients
 	shutdown AtomicInt
 	clients  AtomicInt
 }
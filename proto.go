@@ -30,6 +30,15 @@ type redisClient struct {
 	dbIdx int      // which db to use
 	db    Store
 	arena *Arena
+
+	locked []int // lock stripes held by the running command, see keyLocks
+
+	multi   *transaction       // commands queued since MULTI, nil if not in one
+	writes  map[Store]*txStore // buffered writes of the running EXEC, by db
+	watched []watch            // keys of WATCH, till EXEC, DISCARD or UNWATCH
+
+	cursors    map[uint64][]byte // SCAN cursors too long to be the key, by id
+	lastCursor uint64
 }
 
 func NewReisClient(conn net.Conn) *redisClient {
@@ -43,7 +52,7 @@ func NewReisClient(conn net.Conn) *redisClient {
 }
 
 func parseInt(b []byte) (int, error) {
-	if len(b) == 1 { // optimize the common path
+	if len(b) == 1 && b[0] >= '0' && b[0] <= '9' { // optimize the common path
 		return int(b[0] - '0'), nil
 	}
 	return strconv.Atoi(string(b))
@@ -202,10 +211,12 @@ type Reply interface {
 	Write(bw *BufferedConn) error
 }
 type ErrorReply struct{ message string }
+type CodedErrorReply struct{ code, message string } // error code other than ERROR
 type StatusReply struct{ code string }
 type IntReply struct{ number int }
 type BulkReply struct{ value []byte }
 type MultiBulkReply struct{ values [][]byte }
+type ArrayReply struct{ replies []Reply } // nested replies, like SCAN's. nil for a null array
 
 var (
 	ErrMethodNotSupported   = &ErrorReply{"Method is not supported"}
@@ -213,16 +224,65 @@ var (
 	ErrTooMuchArgs          = &ErrorReply{"Too many arguments for the command"}
 	ErrWrongArgsNumber      = &ErrorReply{"Wrong number of arguments"}
 	ErrExpectInteger        = &ErrorReply{"Expected integer"}
+	ErrExpectFloat          = &ErrorReply{"Expected valid float"}
 	ErrExpectPositivInteger = &ErrorReply{"Expected positive integer"}
 	ErrExpectMorePair       = &ErrorReply{"Expected at least one key val pair"}
 	ErrExpectEvenPair       = &ErrorReply{"Got uneven number of key val pairs"}
+	ErrSyntax               = &ErrorReply{"Syntax error"}
+	ErrInvalidExpire        = &ErrorReply{"Invalid expire time"}
+	ErrDbIndexOutOfRange    = &ErrorReply{"DB index is out of range"}
+	ErrSameObject           = &ErrorReply{"Source and destination objects are the same"}
+	ErrInvalidCursor        = &ErrorReply{"Invalid cursor"}
+	ErrIncrOverflow         = &ErrorReply{"Increment or decrement would overflow"}
+	ErrIncrNaN              = &ErrorReply{"Increment would produce NaN or Infinity"}
+	ErrScoreNaN             = &ErrorReply{"resulting score is not a number (NaN)"}
+	ErrInvalidMeta          = &ErrorReply{"Key meta is too short, corrupted or in another format"}
+	ErrStringTooLong        = &ErrorReply{"String exceeds maximum allowed size (512MB)"}
+	ErrOffsetOutOfRange     = &ErrorReply{"Offset is out of range"}
+	ErrNestedMulti          = &ErrorReply{"MULTI calls can not be nested"}
+	ErrExecWithoutMulti     = &ErrorReply{"EXEC without MULTI"}
+	ErrDiscardWithoutMulti  = &ErrorReply{"DISCARD without MULTI"}
+	ErrWatchInMulti         = &ErrorReply{"WATCH inside MULTI is not allowed"}
+	ErrTimeoutNotFloat      = &ErrorReply{"Timeout is not a float or out of range"}
+	ErrTimeoutNegative      = &ErrorReply{"Timeout is negative"}
+	ErrNoSuchKey            = &ErrorReply{"No such key"}
+	ErrIndexOutOfRange      = &ErrorReply{"Index out of range"}
+	ErrRankZero             = &ErrorReply{"RANK can't be zero"}
+	ErrBitOffset            = &ErrorReply{"Bit offset is not an integer or out of range"}
+	ErrBitValue             = &ErrorReply{"Bit is not an integer or out of range"}
+	ErrBitopNot             = &ErrorReply{"BITOP NOT must be called with a single source key"}
+	ErrBitfieldType         = &ErrorReply{"Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is"}
+	ErrBitfieldOverflow     = &ErrorReply{"Invalid OVERFLOW type specified"}
+	ErrGeoPosition          = &ErrorReply{"Invalid longitude,latitude pair"}
+	ErrGeoUnit              = &ErrorReply{"Unsupported unit provided. please use M, KM, FT, MI"}
+	ErrGeoNegative          = &ErrorReply{"Radius, width and height can not be negative"}
+	ErrGeoMember            = &ErrorReply{"Could not decode requested zset member"}
+	ErrGeoShape             = &ErrorReply{"Exactly one of FROMMEMBER and FROMLONLAT, and one of BYRADIUS and BYBOX must be given"}
+	ErrGeoStoreWith         = &ErrorReply{"STORE is not compatible with WITHDIST, WITHHASH and WITHCOORD"}
+	ErrGeoAny               = &ErrorReply{"ANY requires COUNT"}
+	ErrCountNotPositive     = &ErrorReply{"COUNT must be > 0"}
+
+	ErrWrongType  = &CodedErrorReply{"WRONGTYPE", "Operation against a key holding the wrong kind of value"}
+	ErrExecAbort  = &CodedErrorReply{"EXECABORT", "Transaction discarded because of previous errors"}
+	ErrNotHLL     = &CodedErrorReply{"WRONGTYPE", "Key is not a valid HyperLogLog string value."}
+	ErrInvalidHLL = &CodedErrorReply{"INVALIDOBJ", "Corrupted HLL object detected"}
 )
 
+// handlers can return the predefined replies as error
+func (er ErrorReply) Error() string { return er.message }
+
 func (er ErrorReply) Write(bw *BufferedConn) error {
 	bw.buffer.write([]byte("-ERROR " + er.message + "\r\n"))
 	return nil
 }
 
+func (er CodedErrorReply) Error() string { return er.message }
+
+func (er CodedErrorReply) Write(bw *BufferedConn) error {
+	bw.buffer.write([]byte("-" + er.code + " " + er.message + "\r\n"))
+	return nil
+}
+
 func (r StatusReply) Write(bw *BufferedConn) error {
 	bw.buffer.write([]byte("+" + r.code + "\r\n"))
 	return nil
@@ -246,6 +306,20 @@ func (r MultiBulkReply) Write(bw *BufferedConn) error {
 	return nil
 }
 
+func (r ArrayReply) Write(bw *BufferedConn) error {
+	if r.replies == nil {
+		bw.buffer.write([]byte("*-1\r\n"))
+		return nil
+	}
+	bw.buffer.write([]byte("*" + strconv.Itoa(len(r.replies)) + "\r\n"))
+	for _, reply := range r.replies {
+		if err := reply.Write(bw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (bw *BufferedConn) writeBytes(data []byte) {
 	if data == nil {
 		bw.buffer.write([]byte("$-1\r\n"))
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"sync"
+)
+
+// keys dropped by ttlFilter, by db path, served at /debug/vars
+var compactionReclaimed = expvar.NewMap("compaction_reclaimed")
+
+// how long the meta of the last key looked at is trusted to keep its data keys, in ms
+const kFilterMetaCacheMs = 1000
+
+// Drops expired strings and lists, list data keys no list points to, and the
+// member and page keys of hashes, sets, zsets and bitmaps which are gone,
+// expired or replaced by another type, while rocksdb compacts. The meta of an
+// expired hash, set, zset or bitmap stays: dropped before its members, a new
+// key of the same name would find them. The sweeper or the next read of the
+// key deletes it.
+type ttlFilter struct {
+	store *RockdbStore // nil until the db is opened
+
+	// Compaction goes through the data keys of a key one after another, the
+	// meta read for the first one keeps the others. Compactions may run at
+	// the same time.
+	sync.Mutex
+	lastKey  []byte // meta key
+	lastMeta []byte // nil if missing
+	lastRead int64  // unix ms
+}
+
+func (f *ttlFilter) Name() string {
+	return "rockredis.ttl"
+}
+
+func (f *ttlFilter) Filter(level int, key, val []byte) (bool, []byte) {
+	if len(key) == 0 || f.store == nil { // the format of the db is not checked yet
+		return false, nil
+	}
+
+	remove := false
+	switch key[0] {
+	case kMetaKeyPrefix:
+		remove = len(val) >= kMetaHeaderSize && (metaType(val) == kTypeString || metaType(val) == kTypeList) &&
+			metaExpired(val, nowMs())
+	case kListDataKeyPrefix:
+		remove = f.orphanListData(key)
+	case kHashFieldKeyPrefix, kSetMemberKeyPrefix, kZsetMemberKeyPrefix, kZsetScoreKeyPrefix, kBitmapPageKeyPrefix:
+		remove = f.orphanMember(key)
+	}
+
+	if remove {
+		f.store.reclaimed.Add(1)
+	}
+	return remove, nil
+}
+
+// d + key + ':' + seq: the list is gone, expired, replaced by another type or saved inline, or seq is out of its range
+func (f *ttlFilter) orphanListData(dKey []byte) bool {
+	if f.store == nil || len(dKey) < 6 {
+		return false
+	}
+	seq := int(bigEndian.Uint32(dKey[len(dKey)-4:]))
+	return f.orphan(dKey[1:len(dKey)-5], func(meta []byte, now int64) bool {
+		return listDataOutside(meta, seq, now)
+	})
+}
+
+// prefix + len(key) + key + member: the key is gone, expired or of another type
+func (f *ttlFilter) orphanMember(k []byte) bool {
+	if f.store == nil || len(k) < 5 || len(k)-5 < int(bigEndian.Uint32(k[1:])) {
+		return false
+	}
+	typ := memberType(k[0])
+	return f.orphan(k[5:5+bigEndian.Uint32(k[1:])], func(meta []byte, now int64) bool {
+		return meta == nil || len(meta) < kMetaHeaderSize || metaType(meta) != typ || metaExpired(meta, now)
+	})
+}
+
+// the type of the key a member or page key with prefix belongs to
+func memberType(prefix byte) byte {
+	switch prefix {
+	case kHashFieldKeyPrefix:
+		return kTypeHash
+	case kSetMemberKeyPrefix:
+		return kTypeSet
+	case kBitmapPageKeyPrefix:
+		return kTypeBitmap
+	}
+	return kTypeZset
+}
+
+// outside tells, from the meta of key, whether a data key of it is not needed
+func (f *ttlFilter) orphan(key []byte, outside func(meta []byte, now int64) bool) bool {
+	a := NewArena(0)
+	mKey, now := encodeMetaKey(a, key), nowMs()
+
+	f.Lock()
+	cached, meta := bytes.Equal(f.lastKey, mKey) && now-f.lastRead < kFilterMetaCacheMs, f.lastMeta
+	f.Unlock()
+	if cached && !outside(meta, now) {
+		return false
+	}
+
+	// the key may have been written since, only a fresh meta drops it
+	meta, err := f.store.Get(a, mKey)
+	if err != nil {
+		return false // keep it, when in doubt
+	}
+	f.Lock()
+	f.lastKey, f.lastMeta, f.lastRead = mKey, meta, now
+	f.Unlock()
+	return outside(meta, now)
+}
+
+// seq is not an element of the list of meta, at unix ms now
+func listDataOutside(meta []byte, seq int, now int64) bool {
+	if meta == nil || len(meta) < kMetaHeaderSize || metaType(meta) != kTypeList || metaExpired(meta, now) ||
+		LinkedList(meta).inline() {
+		return true
+	}
+	llen, minseq := LinkedList(meta).listMeta()
+	// the data key is written in the same batch as the meta, an up to date
+	// meta always covers a live element
+	return seq < minseq || seq >= minseq+llen
+}
@@ -1,15 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	db "github.com/tecbot/gorocksdb"
+	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The layout of keys and values, saved in a file next to every db: a meta
+// record with type and expire-at for each key, then its data keys. Before it,
+// strings were saved as they are and lists under 'l', such a db is migrated
+// when it is opened.
+const (
+	kFormatVersion     = 1
+	kFormatVersionFile = "ROCKREDIS_FORMAT"
+
+	kMigratingSuffix = ".migrating"       // the db being written by the migration
+	kBaselineSuffix  = ".before-format-1" // the db as it was before the migration
+	kBaselineListKey = 'l'                // the list meta before format version 1
 )
 
 type RockdbStore struct {
-	ro  *db.ReadOptions
-	rro *db.ReadOptions //  do not fill cache
-	wo  *db.WriteOptions
-	db  *db.DB
+	ro        *db.ReadOptions
+	rro       *db.ReadOptions //  do not fill cache
+	wo        *db.WriteOptions
+	db        *db.DB
+	reclaimed AtomicInt // keys dropped by the compaction filter
 }
 
 func NewRockdbStore(path string, cache int, compress string) (*RockdbStore, error) {
@@ -18,6 +39,8 @@ func NewRockdbStore(path string, cache int, compress string) (*RockdbStore, erro
 	opts.SetCreateIfMissing(true)
 	opts.SetFilterPolicy(db.NewBloomFilter(10))
 	opts.SetTargetFileSizeBase(16 * 1024 * 1024) // 16M, default is 2m
+	filter := &ttlFilter{}
+	opts.SetCompactionFilter(filter)
 
 	switch compress {
 	case "snappy":
@@ -29,27 +52,173 @@ func NewRockdbStore(path string, cache int, compress string) (*RockdbStore, erro
 	}
 
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		if err = os.MkdirAll(path, 0700); err != nil {
+		if _, err = os.Stat(filepath.Join(path+kMigratingSuffix, kFormatVersionFile)); err == nil {
+			// a migration stopped between moving the old db away and the new one in
+			if err = os.Rename(path+kMigratingSuffix, path); err != nil {
+				return nil, err
+			}
+		} else if err = os.MkdirAll(path, 0700); err != nil {
 			return nil, err
 		}
 	}
 
-	if rockdb, err := db.OpenDb(opts, path); err == nil {
-		rro := db.NewDefaultReadOptions()
-		rro.SetFillCache(false)
-		return &RockdbStore{
-			ro:  db.NewDefaultReadOptions(),
-			wo:  db.NewDefaultWriteOptions(),
-			rro: rro,
-			db:  rockdb,
-		}, nil
-	} else {
+	store, err := openStore(opts, path)
+	if err != nil {
 		return nil, err
 	}
+	if baseline, err := store.checkFormat(path); err != nil {
+		store.Close()
+		return nil, err
+	} else if baseline {
+		store.Close()
+		if err := migrateFormat(path); err != nil {
+			return nil, err
+		}
+		return NewRockdbStore(path, cache, compress)
+	}
+	filter.store = store
+	compactionReclaimed.Set(path, &store.reclaimed)
+	return store, nil
+}
+
+func openStore(opts *db.Options, path string) (*RockdbStore, error) {
+	rockdb, err := db.OpenDb(opts, path)
+	if err != nil {
+		return nil, err
+	}
+	rro := db.NewDefaultReadOptions()
+	rro.SetFillCache(false)
+	return &RockdbStore{
+		ro:  db.NewDefaultReadOptions(),
+		wo:  db.NewDefaultWriteOptions(),
+		rro: rro,
+		db:  rockdb,
+	}, nil
+}
+
+// a db at path written in another format is not opened, a new one gets
+// kFormatVersion. baseline is true for a db saved before format version 1.
+func (s *RockdbStore) checkFormat(path string) (baseline bool, err error) {
+	file := filepath.Join(path, kFormatVersionFile)
+	if v, err := ioutil.ReadFile(file); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(v))); err != nil || n != kFormatVersion {
+			return false, fmt.Errorf("%s: data format version %q, expect %d", path, v, kFormatVersion)
+		}
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	empty := true
+	if err := s.Scan(NewArena(0), []byte{}, func(k, v []byte) bool {
+		empty = false
+		return false
+	}); err != nil || !empty {
+		return !empty, err
+	}
+	return false, ioutil.WriteFile(file, []byte(strconv.Itoa(kFormatVersion)+"\n"), 0600)
 }
 
+// Rewrites the db at path saved before format version 1: a string gets a meta
+// header, a list meta moves from 'l' to 'k', list data keys stay as they are.
+// The new db is written at path + kMigratingSuffix, then swapped in, the old
+// one is kept at path + kBaselineSuffix till it is removed by hand.
+func migrateFormat(path string) error {
+	tmp, backup := path+kMigratingSuffix, path+kBaselineSuffix
+	if _, err := os.Stat(backup); err == nil {
+		return fmt.Errorf("%s: data saved before format version %d, move %s away to migrate it", path, kFormatVersion, backup)
+	}
+	if err := os.RemoveAll(tmp); err != nil { // left by a migration that did not finish
+		return err
+	} else if err = os.MkdirAll(tmp, 0700); err != nil {
+		return err
+	}
+	opts := db.NewDefaultOptions()
+	opts.SetCreateIfMissing(true)
+	from, err := openStore(opts, path)
+	if err != nil {
+		return err
+	}
+	to, err := openStore(opts, tmp)
+	if err != nil {
+		from.Close()
+		return err
+	}
+	dropped, err := copyBaseline(from, to, path)
+	from.Close()
+	to.Close()
+	if err != nil {
+		return err
+	} else if err = ioutil.WriteFile(filepath.Join(tmp, kFormatVersionFile), []byte(strconv.Itoa(kFormatVersion)+"\n"), 0600); err != nil {
+		return err
+	} else if err = os.Rename(path, backup); err != nil {
+		return err
+	} else if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	log.Printf("%s: migrated to format version %d, %d strings dropped, the old db is kept at %s", path, kFormatVersion, dropped, backup)
+	return nil
+}
+
+// writes every key of from to to, in format version 1. A string with the name
+// of a list is dropped, the list wins as it did before.
+func copyBaseline(from, to *RockdbStore, path string) (dropped int, err error) {
+	// the meta of the list key in from, nil if there is no such list
+	list := func(a *Arena, key []byte) ([]byte, error) {
+		lKey := a.Allocate(len(key) + 1)
+		lKey[0] = kBaselineListKey
+		copy(lKey[1:], key)
+		if meta, err := from.Get(a, lKey); err != nil || len(meta) != kListMetaSize {
+			return nil, err
+		} else {
+			return meta, nil
+		}
+	}
+	// the key and value of k in format version 1, a nil key if it is dropped
+	migrate := func(a *Arena, k, v []byte) ([]byte, []byte, error) {
+		if k[0] == kBaselineListKey && len(v) == kListMetaSize {
+			meta := newMeta(a, kTypeList, kListMetaSize)
+			copy(meta[kMetaHeaderSize:], v)
+			return encodeMetaKey(a, k[1:]), meta, nil
+		} else if k[0] == kListDataKeyPrefix && len(k) >= 6 && k[len(k)-5] == ':' {
+			if meta, err := list(a, k[1:len(k)-5]); err != nil || meta != nil {
+				return k, v, err
+			}
+		}
+		if meta, err := list(a, k); err != nil || meta != nil {
+			return nil, nil, err
+		}
+		meta := newMeta(a, kTypeString, len(v))
+		copy(meta[kMetaHeaderSize:], v)
+		return encodeMetaKey(a, k), meta, nil
+	}
+
+	var ks, vs [][]byte
+	scanErr := from.Scan(NewArena(0), []byte{}, func(k, v []byte) bool {
+		key, value, e := migrate(NewArena(0), k, v)
+		if err = e; err != nil {
+			return false
+		} else if key == nil {
+			log.Printf("%s: string %q is dropped by the migration, a list has its name", path, k)
+			dropped += 1
+			return true
+		}
+		if ks, vs = append(ks, key), append(vs, value); len(ks) >= 1024 {
+			err, ks, vs = to.Batch(ks, vs), ks[:0], vs[:0]
+		}
+		return err == nil
+	})
+	if err != nil {
+		return dropped, err
+	} else if scanErr != nil {
+		return dropped, scanErr
+	}
+	return dropped, to.Batch(ks, vs)
+}
+
+// nil if key is missing, an empty slice if its value is empty
 func (s *RockdbStore) Get(a *Arena, key []byte) ([]byte, error) {
-	if value, err := s.db.Get(s.ro, key); err == nil && value.Size() > 0 {
+	if value, err := s.db.Get(s.ro, key); err == nil && value.Exists() {
+		defer value.Free()
 		bf := a.Allocate(value.Size())
 		copy(bf, value.Data())
 		return bf, nil
@@ -66,6 +235,11 @@ func (s *RockdbStore) Delete(key []byte) error {
 	return s.db.Delete(s.wo, key)
 }
 
+// how many keys the compaction filter dropped since the db is opened
+func (s *RockdbStore) Reclaimed() int64 {
+	return s.reclaimed.Get()
+}
+
 func (s *RockdbStore) Flush() error {
 	opts := db.NewDefaultFlushOptions()
 	defer opts.Destroy()
@@ -90,23 +264,57 @@ func (s *RockdbStore) Batch(ks, vs [][]byte) error {
 }
 
 func (s *RockdbStore) Scan(a *Arena, start []byte, collector func(key, val []byte) bool) error {
-	it := s.db.NewIterator(s.rro)
+	return s.ScanRange(a, start, nil, false, collector)
+}
+
+func (s *RockdbStore) ScanRange(a *Arena, start, limit []byte, reverse bool, collector func(key, val []byte) bool) error {
+	ro := s.rro
+	if limit != nil && !reverse {
+		// let rocksdb stop at limit, instead of stepping over deleted keys beyond it
+		ro = db.NewDefaultReadOptions()
+		ro.SetFillCache(false)
+		ro.SetIterateUpperBound(limit)
+		defer ro.Destroy()
+	}
+	it := s.db.NewIterator(ro)
 	defer it.Close()
-	it.Seek(start)
 
-	for it = it; it.Valid(); it.Next() {
-		// key := it.Key()
-		value := it.Value()
-		bf := a.Allocate(value.Size())
-		copy(bf, value.Data())
+	if !reverse {
+		it.Seek(start)
+	} else if limit == nil {
+		it.SeekToLast()
+	} else if it.Seek(limit); it.Valid() {
+		it.Prev() // the last key < limit
+	} else {
+		it.SeekToLast()
+	}
 
-		if !collector(nil, bf) {
+	for ; it.Valid(); s.step(it, reverse) {
+		key, value := it.Key(), it.Value()
+		if (reverse && bytes.Compare(key.Data(), start) < 0) ||
+			(!reverse && limit != nil && bytes.Compare(key.Data(), limit) >= 0) {
+			key.Free()
 			value.Free()
 			break
-		} else {
-			value.Free()
+		}
+		kb, vb := a.Allocate(key.Size()), a.Allocate(value.Size())
+		copy(kb, key.Data())
+		copy(vb, value.Data())
+		key.Free()
+		value.Free()
+
+		if !collector(kb, vb) {
+			break
 		}
 	}
 
-	return nil
+	return it.Err()
+}
+
+func (s *RockdbStore) step(it *db.Iterator, reverse bool) {
+	if reverse {
+		it.Prev()
+	} else {
+		it.Next()
+	}
 }
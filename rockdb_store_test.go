@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	db "github.com/tecbot/gorocksdb"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestRockdbStore(t *testing.T) {
@@ -52,6 +55,10 @@ func TestRockdbStore(t *testing.T) {
 			t.Error(err, r)
 		}
 	}
+	db.Set([]byte("empty"), []byte{})
+	if r, err := db.Get(a, []byte("empty")); err != nil || r == nil || len(r) != 0 {
+		t.Errorf("expect an empty value, not a missing one, get %q, %v", r, err)
+	}
 	db.Close()
 }
 
@@ -83,3 +90,208 @@ func BenchmarkRockdbStore(b *testing.B) {
 		db.Close()
 	}
 }
+
+func TestRockdbStoreScanRange(t *testing.T) {
+	path, err := ioutil.TempDir("", "rockredis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	db, err := NewRockdbStore(path, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		db.Set([]byte(k), []byte(k))
+	}
+
+	a := NewArena(32 * 1024)
+	collect := func(start, limit string, reverse bool) string {
+		var keys []byte
+		var l []byte
+		if limit != "" {
+			l = []byte(limit)
+		}
+		db.ScanRange(a, []byte(start), l, reverse, func(k, v []byte) bool {
+			keys = append(keys, k...)
+			return true
+		})
+		return string(keys)
+	}
+
+	if keys := collect("b", "d", false); keys != "bc" {
+		t.Errorf("expect bc, get %v", keys)
+	}
+	if keys := collect("b", "d", true); keys != "cb" {
+		t.Errorf("expect cb, get %v", keys)
+	}
+	if keys := collect("", "", true); keys != "dcba" {
+		t.Errorf("expect dcba, get %v", keys)
+	}
+	if keys := collect("bb", "z", true); keys != "dc" {
+		t.Errorf("expect dc, get %v", keys)
+	}
+}
+
+func TestTtlFilter(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+	store := c.db.(*RockdbStore)
+
+	h.Psetex(c, []byte("gone"), 1, []byte("v"))
+	h.Set(c, []byte("stay"), []byte("v"))
+	h.Rpush(c, []byte("list"), []byte("a"), []byte("b"), []byte("c"))
+	// an element written by a list that is deleted without cleanup
+	store.Set(listDataKey(c.arena, encodeMetaKey(c.arena, []byte("list")), SeqStart+10), []byte("x"))
+	time.Sleep(time.Millisecond * 5)
+
+	store.db.CompactRange(db.Range{})
+	if n := store.Reclaimed(); n != 1+1 {
+		t.Errorf("expect 2 keys reclaimed, get %v", n)
+	}
+	if v, _ := h.Get(c, []byte("stay")); string(v) != "v" {
+		t.Errorf("expect v, get %s", v)
+	}
+	if r, _ := h.Lrange(c, []byte("list"), 0, -1); len(r) != 3 {
+		t.Errorf("expect 3 elements, get %q", r)
+	}
+}
+
+func TestTtlFilterListMeta(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+	store := c.db.(*RockdbStore)
+	f := &ttlFilter{store: store}
+	mKey := encodeMetaKey(c.arena, []byte("list"))
+	dropped := func(seq int) bool {
+		remove, _ := f.Filter(0, listDataKey(c.arena, mKey, seq), []byte("v"))
+		return remove
+	}
+
+	h.Rpush(c, []byte("list"), bytes.Repeat([]byte("v"), kMaxCompactValue+1), []byte("b"))
+	if dropped(SeqStart) {
+		t.Error("expect the element kept")
+	}
+	h.Rpush(c, []byte("list"), []byte("c")) // past the meta read
+	if dropped(SeqStart + 2) {
+		t.Error("expect a new element kept")
+	}
+
+	store.Delete(mKey) // gone without cleanup, the meta read is still trusted for a while
+	if dropped(SeqStart + 1) {
+		t.Error("expect the element kept by the meta read")
+	}
+	f.lastRead -= kFilterMetaCacheMs
+	if !dropped(SeqStart + 1) {
+		t.Error("expect the element dropped")
+	}
+}
+
+func TestTtlFilterMembers(t *testing.T) {
+	h, c, done := newTestClient(t)
+	defer done()
+	f := &ttlFilter{store: c.db.(*RockdbStore)}
+	dropped := func(k []byte) bool {
+		remove, _ := f.Filter(0, k, []byte{})
+		return remove
+	}
+
+	long := bytes.Repeat([]byte("m"), kMaxCompactValue+1)
+	h.Sadd(c, []byte("s"), long, []byte("b"))
+	h.Zadd(c, []byte("z"), []byte("1"), long)
+	mKey, zKey := encodeMetaKey(c.arena, []byte("s")), encodeMetaKey(c.arena, []byte("z"))
+	if dropped(setMemberKey(c.arena, mKey, long)) || dropped(zsetScoreKey(c.arena, zKey, 1, long)) {
+		t.Error("expect the members kept")
+	}
+	if !dropped(hashFieldKey(c.arena, mKey, long)) {
+		t.Error("expect a field of a set dropped")
+	}
+	if !dropped(bitmapPageKey(c.arena, encodeMetaKey(c.arena, []byte("none")), 0)) {
+		t.Error("expect a page of a missing key dropped")
+	}
+
+	h.Pexpire(c, []byte("s"), 1)
+	time.Sleep(time.Millisecond * 5)
+	if !dropped(setMemberKey(c.arena, mKey, []byte("b"))) {
+		t.Error("expect a member of an expired set dropped")
+	}
+	if remove, _ := f.Filter(0, mKey, f.lastMeta); remove {
+		t.Error("expect the meta of an expired set kept")
+	}
+}
+
+func TestFormatVersion(t *testing.T) {
+	path, err := ioutil.TempDir("", "rockredis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	store, err := NewRockdbStore(path, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set([]byte("kold"), []byte("v")) // a string before the meta header
+	store.Close()
+	if store, err = NewRockdbStore(path, 0, ""); err != nil {
+		t.Fatalf("expect the version of a new db kept, get %v", err)
+	}
+	h, c := &DbHandler{}, NewReisClient(&MockConn{})
+	c.db = store
+	if _, err := h.Get(c, []byte("old")); err != ErrInvalidMeta {
+		t.Errorf("expect invalid meta, get %v", err)
+	}
+	if r, err := h.Scan(c, []byte("0")); err != nil || len(r.(ArrayReply).replies[1].(MultiBulkReply).values) != 0 {
+		t.Errorf("expect the short meta skipped, get %v, %v", r, err)
+	}
+	store.Close()
+
+	ioutil.WriteFile(filepath.Join(path, kFormatVersionFile), []byte("2\n"), 0600)
+	if _, err := NewRockdbStore(path, 0, ""); err == nil {
+		t.Error("expect another version refused")
+	}
+}
+
+func TestFormatMigration(t *testing.T) {
+	path, err := ioutil.TempDir("", "rockredis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	defer os.RemoveAll(path + kBaselineSuffix)
+
+	// saved before format version 1
+	old, err := openStore(db.NewDefaultOptions(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewArena(0)
+	meta := make([]byte, kListMetaSize)
+	bigEndian.PutUint32(meta, 2)
+	bigEndian.PutUint32(meta[4:], SeqStart)
+	mKey := encodeMetaKey(a, []byte("list"))
+	old.Batch([][]byte{[]byte("name"), []byte("llist"), listDataKey(a, mKey, SeqStart), listDataKey(a, mKey, SeqStart+1), []byte("list"), []byte("dx")},
+		[][]byte{[]byte("v"), meta, []byte("a"), []byte("b"), []byte("x"), []byte("y")})
+	old.Close()
+
+	store, err := NewRockdbStore(path, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	h, c := &DbHandler{}, NewReisClient(&MockConn{})
+	c.db = store
+	if v, err := h.Get(c, []byte("name")); string(v) != "v" || err != nil {
+		t.Errorf("expect v, get %q, %v", v, err)
+	}
+	if v, _ := h.Get(c, []byte("dx")); string(v) != "y" {
+		t.Errorf("expect y, get %q", v)
+	}
+	if r, err := h.Lrange(c, []byte("list"), 0, -1); len(r) != 2 || string(r[1]) != "b" || err != nil {
+		t.Errorf("expect a b, get %q, %v", r, err)
+	}
+	if _, err := os.Stat(path + kBaselineSuffix); err != nil {
+		t.Errorf("expect the old db kept, get %v", err)
+	}
+}
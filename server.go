@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -12,27 +13,79 @@ import (
 )
 
 func NewServer(cfg *RockRedisConf) (*Server, error) {
+	dirs, err := readDbDirs(cfg)
+	if err != nil {
+		return nil, err
+	}
 	dbs := make([]Store, cfg.Databases)
-	for i := 0; i < cfg.Databases; i++ {
-		dir := path.Join(cfg.Dir, "db-"+strconv.Itoa(i+1))
-		if db, err := NewRockdbStore(dir, cfg.Cache, cfg.Compression); err != nil {
+	for i, dir := range dirs {
+		if db, err := NewRockdbStore(path.Join(cfg.Dir, dir), cfg.Cache, cfg.Compression); err != nil {
 			return nil, err
 		} else {
-			dbs[i] = db
+			dbs[i] = newWatchStore(db)
 		}
 	}
 	s := &Server{
 		conf:     cfg,
 		handlers: make(map[string]HandlerFn),
 		dbs:      dbs,
+		dirs:     dirs,
+		blocked:  newBlockedClients(),
 	}
 
 	if err := s.RegisterHandlers(&DbHandler{server: s}); err != nil {
 		return nil, err
 	}
+	go s.sweep()
 	return s, nil
 }
 
+// the file keeps which dir each db index is opened from, after SWAPDB
+func dbDirsFile(cfg *RockRedisConf) string {
+	return path.Join(cfg.Dir, "databases")
+}
+
+// db-1, db-2... unless SWAPDB reordered them
+func readDbDirs(cfg *RockRedisConf) ([]string, error) {
+	dirs := make([]string, cfg.Databases)
+	for i := 0; i < cfg.Databases; i++ {
+		dirs[i] = "db-" + strconv.Itoa(i+1)
+	}
+
+	if data, err := ioutil.ReadFile(dbDirsFile(cfg)); os.IsNotExist(err) {
+		return dirs, nil
+	} else if err != nil {
+		return nil, err
+	} else if saved := strings.Fields(string(data)); len(saved) != cfg.Databases {
+		return nil, fmt.Errorf("%v lists %v dbs, %v configured", dbDirsFile(cfg), len(saved), cfg.Databases)
+	} else {
+		return saved, nil
+	}
+}
+
+func (s *Server) writeDbDirs() error {
+	tmp := dbDirsFile(s.conf) + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(s.dirs, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dbDirsFile(s.conf))
+}
+
+func (s *Server) db(idx int) Store {
+	s.dbsLock.RLock()
+	defer s.dbsLock.RUnlock()
+	return s.dbs[idx]
+}
+
+// swap db i and j, for all clients, and across restart
+func (s *Server) swapDb(i, j int) error {
+	s.dbsLock.Lock()
+	defer s.dbsLock.Unlock()
+	s.dbs[i], s.dbs[j] = s.dbs[j], s.dbs[i]
+	s.dirs[i], s.dirs[j] = s.dirs[j], s.dirs[i]
+	return s.writeDbDirs()
+}
+
 func (s *Server) ListenAndServe() error {
 	if l, err := net.Listen("tcp", s.conf.Addr); err == nil {
 		for s.shutdown.Get() == 0 {
@@ -49,8 +102,7 @@ func (s *Server) ListenAndServe() error {
 }
 
 func (s *Server) ServeClient(c net.Conn) {
-	client := NewReisClient(c)
-	client.db = s.dbs[0] // default is database 0
+	client := NewReisClient(c) // default is database 0
 	s.clients.Add(1)
 
 	for s.shutdown.Get() == 0 {
@@ -60,6 +112,7 @@ func (s *Server) ServeClient(c net.Conn) {
 			break
 		}
 
+		client.db = s.db(client.dbIdx) // SWAPDB may change it any time
 		res, err := s.Handle(client, req)
 		if err != nil {
 			c.Close()
@@ -74,6 +127,7 @@ func (s *Server) ServeClient(c net.Conn) {
 		client.arena.Reset()
 	}
 
+	client.unwatchAll()
 	// no runing clients, server get shutdown signal
 	if s.clients.Add(-1) == 0 && s.shutdown.Get() != 0 {
 		s.Shutdown()
@@ -82,6 +136,7 @@ func (s *Server) ServeClient(c net.Conn) {
 
 func (s *Server) Shutdown() {
 	if s.shutdown.CompareAndSwap(ScheduleShutDown, CloseCalled) { // run only once
+		unlinking.drain() // data keys unlinked but not deleted yet would be left for good
 		log.Printf("Closing all %v dbs", len(s.dbs))
 		for i := 0; i < len(s.dbs); i++ {
 			if err := s.dbs[i].Close(); err != nil {
@@ -94,7 +149,16 @@ func (s *Server) Shutdown() {
 }
 
 func (s *Server) Handle(client *redisClient, req *Request) (Reply, error) {
-	if fn, ok := s.handlers[req.Command]; ok {
+	fn, ok := s.handlers[req.Command]
+	if client.multi != nil && !txCommands[req.Command] {
+		if !ok {
+			client.multi.dirty = true
+			return ErrMethodNotSupported, nil
+		}
+		client.multi.queue(req)
+		return StatusReply{"QUEUED"}, nil
+	}
+	if ok {
 		return fn(client, req)
 	} else {
 		return ErrMethodNotSupported, nil
@@ -161,6 +225,9 @@ func (s *Server) RegisterHandlers(handler interface{}) error {
 			}
 
 			if err := results[len(results)-1].Interface(); err != nil {
+				if r, ok := err.(Reply); ok {
+					return r, nil
+				}
 				return ErrorReply{err.(error).Error()}, nil
 			}
 
@@ -173,6 +240,8 @@ func (s *Server) RegisterHandlers(handler interface{}) error {
 					return MultiBulkReply{v}, nil
 				case int:
 					return IntReply{v}, nil
+				case Reply:
+					return v, nil
 				}
 			}
 			return StatusReply{"OK"}, nil
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 type testInt struct {
@@ -83,3 +87,71 @@ func BenchmarkCallHandler(b *testing.B) {
 		s.Handle(testClient, req)
 	}
 }
+
+// a server with dbs in a temp dir, call the returned func to clean up
+func newTestServer(t *testing.T, dbs int) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "rockredis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(&RockRedisConf{Dir: dir, Databases: dbs, Compression: "snappy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.shutdown.Set(ScheduleShutDown) // stop the sweeper
+		time.Sleep(sweepInterval * 2)
+		for _, db := range s.dbs {
+			db.Close()
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// a request as read from the wire
+func newRequest(args ...string) *Request {
+	req := &Request{Command: strings.ToUpper(args[0]), Size: len(args) - 1}
+	for _, arg := range args[1:] {
+		req.Arguments = append(req.Arguments, []byte(arg))
+	}
+	return req
+}
+
+func TestSelectMoveSwapdb(t *testing.T) {
+	s, done := newTestServer(t, 2)
+	defer done()
+
+	h, c := &DbHandler{server: s}, NewReisClient(&MockConn{})
+	c.db = s.db(0)
+	h.Rpush(c, []byte("list"), []byte("a"), []byte("b"))
+	h.Expire(c, []byte("list"), 100)
+
+	if err := h.Select(c, 2); err == nil {
+		t.Error("db 2 should be out of range")
+	}
+	if n, err := h.Move(c, []byte("list"), 1); n != 1 || err != nil {
+		t.Errorf("expect moved, get %v, %v", n, err)
+	}
+	if n, _ := h.Llen(c, []byte("list")); n != 0 {
+		t.Errorf("expect list moved away, get %v", n)
+	}
+
+	h.Select(c, 1)
+	if r, _ := h.Lrange(c, []byte("list"), 0, -1); len(r) != 2 {
+		t.Errorf("expect 2 elements, get %q", r)
+	}
+	if n, _ := h.Ttl(c, []byte("list")); n != 100 {
+		t.Errorf("expect ttl kept, get %v", n)
+	}
+
+	if err := h.Swapdb(c, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if dirs, _ := readDbDirs(s.conf); dirs[0] != "db-2" {
+		t.Errorf("expect swap saved, get %v", dirs)
+	}
+	h.Select(c, 0)
+	if n, _ := h.Llen(c, []byte("list")); n != 2 {
+		t.Errorf("expect the list in db 0 after swap, get %v", n)
+	}
+}
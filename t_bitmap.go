@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+)
+
+// A string of up to a page is saved in its meta like any other. A longer one
+// written by the bit commands is a bitmap: the meta is header + size in
+// bytes, the value is split in pages, each saved as p + len(key) + key + page
+// index. A page is as long as the value is, missing or short pages are zeros.
+const kBitmapPageSize = 4096
+
+// a string as the bit commands see it, and the pages they change
+type bitmap struct {
+	c     *redisClient
+	mKey  []byte
+	meta  []byte // nil for a new key
+	size  int
+	pages map[int][]byte // written, saved by records
+}
+
+func newBitmap(c *redisClient, mKey []byte) *bitmap {
+	return &bitmap{c: c, mKey: mKey, pages: make(map[int][]byte)}
+}
+
+// the string or bitmap at key, an empty one if it's missing
+func loadBitmap(c *redisClient, key []byte) (*bitmap, error) {
+	b := newBitmap(c, encodeMetaKey(c.arena, key))
+	meta, err := getMeta(c, b.mKey, 0)
+	if err != nil || meta == nil {
+		return b, err
+	}
+	switch metaType(meta) {
+	case kTypeString:
+		b.size = len(meta) - kMetaHeaderSize
+	case kTypeBitmap:
+		b.size = int(bigEndian.Uint32(meta[kMetaHeaderSize:]))
+	default:
+		return nil, ErrWrongType
+	}
+	b.meta = meta
+	return b, nil
+}
+
+func bitmapPageKey(a *Arena, mKey []byte, i int) []byte {
+	idx := a.Allocate(4)
+	bigEndian.PutUint32(idx, uint32(i))
+	return memberKey(a, kBitmapPageKeyPrefix, mKey, idx)
+}
+
+func (b *bitmap) paged() bool {
+	return b.meta != nil && metaType(b.meta) == kTypeBitmap
+}
+
+// page i as it is now, nil or short if the rest is zeros
+func (b *bitmap) readPage(i int) ([]byte, error) {
+	if p, ok := b.pages[i]; ok {
+		return p, nil
+	} else if b.paged() {
+		return b.c.db.Get(b.c.arena, bitmapPageKey(b.c.arena, b.mKey, i))
+	} else if off, n := i*kBitmapPageSize, len(b.meta)-kMetaHeaderSize; off < n { // a string
+		end := off + kBitmapPageSize
+		if end > n {
+			end = n
+		}
+		return b.meta[kMetaHeaderSize+off : kMetaHeaderSize+end], nil
+	}
+	return nil, nil
+}
+
+// page i, a full page to write to
+func (b *bitmap) page(i int) ([]byte, error) {
+	if p, ok := b.pages[i]; ok {
+		return p, nil
+	}
+	v, err := b.readPage(i)
+	if err != nil {
+		return nil, err
+	}
+	p := make([]byte, kBitmapPageSize)
+	copy(p, v)
+	b.pages[i] = p
+	return p, nil
+}
+
+// call fn with pages from first to last, inclusive, in order, until it returns false
+func (b *bitmap) scanPages(first, last int, fn func(i int, p []byte) bool) error {
+	if !b.paged() {
+		for i := first; i <= last; i++ {
+			if p, err := b.readPage(i); err != nil || !fn(i, p) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	next, stopped := first, false
+	err := b.c.db.ScanRange(b.c.arena, bitmapPageKey(b.c.arena, b.mKey, first),
+		bitmapPageKey(b.c.arena, b.mKey, last+1), false, func(k, v []byte) bool {
+			i := int(bigEndian.Uint32(k[len(k)-4:]))
+			for ; next < i && !stopped; next++ { // missing pages are zeros
+				stopped = !fn(next, nil)
+			}
+			if !stopped {
+				stopped, next = !fn(i, v), i+1
+			}
+			return !stopped
+		})
+	for ; err == nil && next <= last && !stopped; next++ {
+		stopped = !fn(next, nil)
+	}
+	return err
+}
+
+// the byte at offset, zero past the end
+func (b *bitmap) byteAt(offset int) (byte, error) {
+	p, err := b.readPage(offset / kBitmapPageSize)
+	if off := offset % kBitmapPageSize; err != nil || off >= len(p) {
+		return 0, err
+	} else {
+		return p[off], nil
+	}
+}
+
+func (b *bitmap) setByte(offset int, v byte) error {
+	p, err := b.page(offset / kBitmapPageSize)
+	if err != nil {
+		return err
+	}
+	p[offset%kBitmapPageSize] = v
+	if offset >= b.size {
+		b.size = offset + 1
+	}
+	return nil
+}
+
+func (b *bitmap) getBit(offset int) (int, error) {
+	v, err := b.byteAt(offset / 8)
+	return int(v>>(7-uint(offset%8))) & 1, err
+}
+
+func (b *bitmap) setBit(offset, bit int) error {
+	v, err := b.byteAt(offset / 8)
+	if err != nil {
+		return err
+	}
+	mask := byte(1) << (7 - uint(offset%8))
+	if bit == 1 {
+		v |= mask
+	} else {
+		v &^= mask
+	}
+	return b.setByte(offset/8, v)
+}
+
+// The records to save what's written, ttl kept. A string stays one unless it
+// outgrows a page, then all its pages are written once. Pages of zeros are deleted.
+func (b *bitmap) records() (ks, vs [][]byte, err error) {
+	a := b.c.arena
+	var at int64
+	if b.meta != nil {
+		at = metaExpireAt(b.meta)
+	}
+	if !b.paged() && b.size <= kBitmapPageSize {
+		v := newMeta(a, kTypeString, b.size)
+		p, err := b.readPage(0)
+		if err != nil {
+			return nil, nil, err
+		}
+		copy(v[kMetaHeaderSize:], p)
+		setMetaExpireAt(v, at)
+		return [][]byte{b.mKey}, [][]byte{v}, nil
+	}
+
+	meta := newMeta(a, kTypeBitmap, 4)
+	bigEndian.PutUint32(meta[kMetaHeaderSize:], uint32(b.size))
+	setMetaExpireAt(meta, at)
+	ks, vs = [][]byte{b.mKey}, [][]byte{meta}
+	if !b.paged() && b.meta != nil { // was a string
+		for i := 0; i*kBitmapPageSize < len(b.meta)-kMetaHeaderSize; i++ {
+			if _, err := b.page(i); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	for i, p := range b.pages {
+		if end := b.size - i*kBitmapPageSize; end < len(p) {
+			p = p[:end]
+		}
+		if len(bytes.Trim(p, "\x00")) == 0 {
+			p = nil
+		}
+		ks, vs = append(ks, bitmapPageKey(a, b.mKey, i)), append(vs, p)
+	}
+	return ks, vs, nil
+}
+
+func (b *bitmap) save() error {
+	ks, vs, err := b.records()
+	if err != nil {
+		return err
+	}
+	return b.c.db.Batch(ks, vs)
+}
+
+// the value of a string or bitmap meta, read from its pages if it has
+func stringValue(c *redisClient, mKey, meta []byte) ([]byte, error) {
+	if metaType(meta) == kTypeString {
+		return meta[kMetaHeaderSize:], nil
+	}
+	b := &bitmap{c: c, mKey: mKey, meta: meta, size: int(bigEndian.Uint32(meta[kMetaHeaderSize:]))}
+	value := make([]byte, b.size)
+	err := b.scanPages(0, (b.size-1)/kBitmapPageSize, func(i int, p []byte) bool {
+		copy(value[i*kBitmapPageSize:], p)
+		return true
+	})
+	return value, err
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A geo set is a zset, the score of a member is the 52 bits geohash of its
+// position, like redis: the cell indexes of longitude and latitude, 26 bits
+// each, interleaved, longitude bits first. Members close to each other have
+// close scores, the members in a cell of any size are a range of scores.
+const (
+	kGeoStep      = 26
+	kGeoLatMax    = 85.05112878 // of web mercator, beyond it there are no cells
+	kGeoLonMax    = 180.0
+	kEarthRadius  = 6372797.560856 // meters, as redis
+	kMercatorMax  = 20037726.37    // meters, half the equator
+	kGeoLatScale  = kGeoLatMax - -kGeoLatMax
+	kGeoLonScale  = kGeoLonMax - -kGeoLonMax
+	kGeoCellCount = 1 << kGeoStep
+)
+
+// meters in a unit of distance
+var geoUnits = map[string]float64{"M": 1, "KM": 1000, "FT": 0.3048, "MI": 1609.34}
+
+func parseGeoUnit(b []byte) (float64, error) {
+	if unit, ok := geoUnits[strings.ToUpper(string(b))]; ok {
+		return unit, nil
+	}
+	return 0, ErrGeoUnit
+}
+
+func parseGeoPosition(lon, lat []byte) (float64, float64, error) {
+	x, err := parseScore(lon)
+	if err != nil {
+		return 0, 0, err
+	}
+	y, err := parseScore(lat)
+	if err != nil {
+		return 0, 0, err
+	}
+	if x < -kGeoLonMax || x > kGeoLonMax || y < -kGeoLatMax || y > kGeoLatMax {
+		return 0, 0, ErrGeoPosition
+	}
+	return x, y, nil
+}
+
+// the bits of v at the even positions
+func spreadBits(v uint64) uint64 {
+	v &= 0xffffffff
+	v = (v | v<<16) & 0x0000ffff0000ffff
+	v = (v | v<<8) & 0x00ff00ff00ff00ff
+	v = (v | v<<4) & 0x0f0f0f0f0f0f0f0f
+	v = (v | v<<2) & 0x3333333333333333
+	v = (v | v<<1) & 0x5555555555555555
+	return v
+}
+
+// the bits of v at the even positions, packed
+func squashBits(v uint64) uint64 {
+	v &= 0x5555555555555555
+	v = (v | v>>1) & 0x3333333333333333
+	v = (v | v>>2) & 0x0f0f0f0f0f0f0f0f
+	v = (v | v>>4) & 0x00ff00ff00ff00ff
+	v = (v | v>>8) & 0x0000ffff0000ffff
+	v = (v | v>>16) & 0x00000000ffffffff
+	return v
+}
+
+// the cell indexes of a position, among 2^step cells each way
+func geoCell(lon, lat float64, step uint) (x, y uint64) {
+	n := uint64(1) << step
+	x = uint64((lon + kGeoLonMax) / kGeoLonScale * float64(n))
+	y = uint64((lat + kGeoLatMax) / kGeoLatScale * float64(n))
+	if x >= n { // on the east or north edge
+		x = n - 1
+	}
+	if y >= n {
+		y = n - 1
+	}
+	return x, y
+}
+
+func interleaveCell(x, y uint64) uint64 {
+	return spreadBits(x)<<1 | spreadBits(y)
+}
+
+func geohashEncode(lon, lat float64) uint64 {
+	return interleaveCell(geoCell(lon, lat, kGeoStep))
+}
+
+// the center of the cell of hash, which is where redis says a member is
+func geohashDecode(hash uint64) (lon, lat float64) {
+	x, y := squashBits(hash>>1), squashBits(hash)
+	lon = (-kGeoLonMax + float64(x)/kGeoCellCount*kGeoLonScale + -kGeoLonMax + float64(x+1)/kGeoCellCount*kGeoLonScale) / 2
+	lat = (-kGeoLatMax + float64(y)/kGeoCellCount*kGeoLatScale + -kGeoLatMax + float64(y+1)/kGeoCellCount*kGeoLatScale) / 2
+	return math.Max(-kGeoLonMax, math.Min(lon, kGeoLonMax)), math.Max(-kGeoLatMax, math.Min(lat, kGeoLatMax))
+}
+
+func degToRad(d float64) float64 {
+	return d * (math.Pi / 180)
+}
+
+func radToDeg(r float64) float64 {
+	return r / (math.Pi / 180)
+}
+
+// haversine distance in meters
+func geoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	lat1r, lat2r := degToRad(lat1), degToRad(lat2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	v := math.Sin((degToRad(lon2) - degToRad(lon1)) / 2)
+	return 2 * kEarthRadius * math.Asin(math.Sqrt(u*u+math.Cos(lat1r)*math.Cos(lat2r)*v*v))
+}
+
+// a circle, or a box if width is set, in meters around a center
+type geoShape struct {
+	lon, lat      float64
+	radius        float64
+	width, height float64
+}
+
+// the distance of a position from the center, ok if it's in the shape
+func (s *geoShape) contains(lon, lat float64) (dist float64, ok bool) {
+	if s.width == 0 {
+		dist = geoDistance(s.lon, s.lat, lon, lat)
+		return dist, dist <= s.radius
+	}
+	if kEarthRadius*math.Abs(degToRad(lat)-degToRad(s.lat)) > s.height/2 ||
+		geoDistance(s.lon, lat, lon, lat) > s.width/2 {
+		return 0, false
+	}
+	return geoDistance(s.lon, s.lat, lon, lat), true
+}
+
+// the longitudes and latitudes the shape spans, longitudes may go past 180
+func (s *geoShape) bounds() (minLon, maxLon, minLat, maxLat float64) {
+	width, height := s.width, s.height
+	if width == 0 {
+		width, height = s.radius*2, s.radius*2
+	}
+	latDelta := radToDeg(height / 2 / kEarthRadius)
+	lonDelta := kGeoLonMax // around a pole
+	if top, bottom := s.lat+latDelta, s.lat-latDelta; top < 90 && bottom > -90 {
+		cos := math.Min(math.Cos(degToRad(top)), math.Cos(degToRad(bottom))) // the far side from the equator
+		lonDelta = math.Min(radToDeg(width/2/kEarthRadius/cos), kGeoLonMax)
+	}
+	return s.lon - lonDelta, s.lon + lonDelta, s.lat - latDelta, s.lat + latDelta
+}
+
+// how many bits of each coordinate make cells about as big as the shape, like redis
+func geoSteps(meters, lat float64) uint {
+	if meters == 0 {
+		return kGeoStep
+	}
+	step := 1
+	for ; meters < kMercatorMax; meters *= 2 {
+		step++
+	}
+	step -= 2
+	if lat > 66 || lat < -66 { // cells get narrow
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+	if step < 1 {
+		step = 1
+	} else if step > kGeoStep {
+		step = kGeoStep
+	}
+	return uint(step)
+}
+
+// The score ranges [lo, hi) to scan for the shape: the cell of the center
+// and its neighbors which the shape reaches, with cells big enough for the
+// 3x3 of them to cover the shape.
+func (s *geoShape) ranges() [][2]float64 {
+	radius := s.radius
+	if s.width != 0 {
+		radius = math.Hypot(s.width/2, s.height/2)
+	}
+	minLon, maxLon, minLat, maxLat := s.bounds()
+	step := geoSteps(radius, s.lat)
+	for ; step > 1; step-- {
+		x, y := geoCell(s.lon, s.lat, step)
+		w, h := kGeoLonScale/float64(uint64(1)<<step), kGeoLatScale/float64(uint64(1)<<step)
+		if -kGeoLonMax+(float64(x)-1)*w <= minLon && -kGeoLonMax+(float64(x)+2)*w >= maxLon &&
+			-kGeoLatMax+(float64(y)-1)*h <= minLat && -kGeoLatMax+(float64(y)+2)*h >= maxLat {
+			break
+		}
+	}
+
+	n := int64(1) << step
+	x, y := geoCell(s.lon, s.lat, step)
+	w, h := kGeoLonScale/float64(n), kGeoLatScale/float64(n)
+	shift := uint(2 * (kGeoStep - step))
+	var ranges [][2]float64
+	seen := make(map[uint64]bool, 9)
+	for dy := int64(-1); dy <= 1; dy++ {
+		for dx := int64(-1); dx <= 1; dx++ {
+			cx, cy := int64(x)+dx, int64(y)+dy
+			if cy < 0 || cy >= n {
+				continue
+			}
+			cellLon, cellLat := -kGeoLonMax+float64(cx)*w, -kGeoLatMax+float64(cy)*h
+			if cellLon > maxLon || cellLon+w < minLon || cellLat > maxLat || cellLat+h < minLat {
+				continue // the shape does not reach it
+			}
+			hash := interleaveCell(uint64((cx+n)%n), uint64(cy)) // around the antimeridian
+			if !seen[hash] {
+				seen[hash] = true
+				ranges = append(ranges, [2]float64{float64(hash << shift), float64((hash + 1) << shift)})
+			}
+		}
+	}
+	return ranges
+}
+
+// like redis, with up to 17 decimals and no trailing zeros
+func formatCoordinate(v float64) []byte {
+	s := strings.TrimRight(strconv.FormatFloat(v, 'f', 17, 64), "0")
+	return []byte(strings.TrimSuffix(s, "."))
+}
+
+func formatDistance(meters, unit float64) []byte {
+	return strconv.AppendFloat(nil, meters/unit, 'f', 4, 64)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"time"
+)
+
+// meta: header, count, add-ts, update-ts. Each field is saved as its own key
+type Hash []byte
+
+func NewHash(a *Arena) Hash {
+	now := uint32(time.Now().Unix())
+	hashMeta := newMeta(a, kTypeHash, 12)
+	m := hashMeta[kMetaHeaderSize:]
+	bigEndian.PutUint32(m, 0)       // count
+	bigEndian.PutUint32(m[4:], now) // add-ts
+	bigEndian.PutUint32(m[8:], now) // update-ts
+	return Hash(hashMeta)
+}
+
+func hashFieldKey(a *Arena, mKey, field []byte) []byte {
+	return memberKey(a, kHashFieldKeyPrefix, mKey, field)
+}
+
+func (h Hash) size() int {
+	return int(bigEndian.Uint32(h[kMetaHeaderSize:]))
+}
+
+func (h Hash) setSize(size int) {
+	m := h[kMetaHeaderSize:]
+	bigEndian.PutUint32(m, uint32(size))                  // count
+	bigEndian.PutUint32(m[8:], uint32(time.Now().Unix())) // update-ts
+}
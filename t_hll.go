@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// A HyperLogLog is a string, in the format of redis, so values dumped from
+// redis can be read: "HYLL", the encoding, 3 unused bytes, the cached
+// cardinality in 8 bytes little endian, its top bit set when it's stale, then
+// the registers. Dense is 16384 registers of 6 bits. Sparse is runs of
+// opcodes: ZERO 00xxxxxx, 1 to 64 zero registers; XZERO 01xxxxxx yyyyyyyy, 1
+// to 16384 zero registers; VAL 1vvvvvxx, 1 to 4 registers of value 1 to 32.
+const (
+	kHllP              = 14
+	kHllQ              = 64 - kHllP
+	kHllRegisters      = 1 << kHllP
+	kHllBits           = 6
+	kHllHeaderSize     = 16
+	kHllDenseSize      = kHllHeaderSize + kHllRegisters*kHllBits/8
+	kHllDense          = 0
+	kHllSparse         = 1
+	kHllSparseMaxBytes = 3000 // header included, a longer sparse HyperLogLog becomes dense
+	kHllSparseMaxValue = 32
+)
+
+// the registers of a HyperLogLog, one per byte
+type hllRegisters [kHllRegisters]uint8
+
+type hyperLogLog struct {
+	regs   hllRegisters
+	card   uint64
+	cached bool // card is up to date
+}
+
+// decode a HyperLogLog, ErrNotHLL if v is not one
+func decodeHll(v []byte) (*hyperLogLog, error) {
+	if len(v) < kHllHeaderSize || string(v[:4]) != "HYLL" || v[4] > kHllSparse ||
+		(v[4] == kHllDense && len(v) != kHllDenseSize) {
+		return nil, ErrNotHLL
+	}
+	l := &hyperLogLog{card: binary.LittleEndian.Uint64(v[8:kHllHeaderSize])}
+	l.cached = l.card>>63 == 0
+	regs := &l.regs
+	if v[4] == kHllDense {
+		for i := range regs {
+			regs[i] = denseRegister(v[kHllHeaderSize:], i)
+		}
+		return l, nil
+	}
+
+	i := 0
+	for p := v[kHllHeaderSize:]; len(p) > 0; {
+		switch op := p[0]; {
+		case op&0xc0 == 0x00: // ZERO
+			i, p = i+int(op&0x3f)+1, p[1:]
+		case op&0xc0 == 0x40: // XZERO
+			if len(p) < 2 {
+				return nil, ErrInvalidHLL
+			}
+			i, p = i+(int(op&0x3f)<<8|int(p[1]))+1, p[2:]
+		default: // VAL
+			n := int(op&0x03) + 1
+			if i+n > kHllRegisters {
+				return nil, ErrInvalidHLL
+			}
+			for j := 0; j < n; j++ {
+				regs[i+j] = (op>>2)&0x1f + 1
+			}
+			i, p = i+n, p[1:]
+		}
+	}
+	if i != kHllRegisters {
+		return nil, ErrInvalidHLL
+	}
+	return l, nil
+}
+
+func denseRegister(p []byte, i int) uint8 {
+	b, fb := i*kHllBits/8, uint(i*kHllBits&7)
+	v := p[b] >> fb
+	if b+1 < len(p) {
+		v |= p[b+1] << (8 - fb)
+	}
+	return v & 0x3f
+}
+
+func setDenseRegister(p []byte, i int, v uint8) {
+	b, fb := i*kHllBits/8, uint(i*kHllBits&7)
+	p[b] = p[b]&^(0x3f<<fb) | v<<fb
+	if b+1 < len(p) {
+		p[b+1] = p[b+1]&^(0x3f>>(8-fb)) | v>>(8-fb)
+	}
+}
+
+// sparse if it fits, dense otherwise
+func (l *hyperLogLog) encode() []byte {
+	v := l.regs.sparse()
+	if v == nil {
+		v = make([]byte, kHllDenseSize)
+		for i, r := range l.regs {
+			setDenseRegister(v[kHllHeaderSize:], i, r)
+		}
+	}
+	copy(v, "HYLL")
+	card := l.card
+	if !l.cached {
+		card = 1 << 63
+	}
+	binary.LittleEndian.PutUint64(v[8:kHllHeaderSize], card)
+	return v
+}
+
+// the sparse encoding with an empty header, nil if it's too long or a register too big
+func (regs *hllRegisters) sparse() []byte {
+	v := make([]byte, kHllHeaderSize, kHllHeaderSize+64)
+	v[4] = kHllSparse
+	for i := 0; i < kHllRegisters; {
+		r, run := regs[i], 1
+		for i+run < kHllRegisters && regs[i+run] == r {
+			run++
+		}
+		i += run
+		switch {
+		case r > kHllSparseMaxValue:
+			return nil
+		case r == 0 && run > 64: // XZERO, a run is at most all registers
+			v = append(v, 0x40|byte((run-1)>>8), byte(run-1))
+		case r == 0:
+			v = append(v, byte(run-1))
+		default:
+			for ; run > 0; run -= 4 {
+				n := run
+				if n > 4 {
+					n = 4
+				}
+				v = append(v, 0x80|(r-1)<<2|byte(n-1))
+			}
+		}
+		if len(v) > kHllSparseMaxBytes {
+			return nil
+		}
+	}
+	return v
+}
+
+// add an element, true if a register changes
+func (regs *hllRegisters) add(element []byte) bool {
+	hash := murmurHash64A(element, 0xadc83b19)
+	i := hash & (kHllRegisters - 1)
+	hash = hash>>kHllP | 1<<kHllQ // a run of at most Q zeros
+	count := uint8(bits.TrailingZeros64(hash) + 1)
+	if count > regs[i] {
+		regs[i] = count
+		return true
+	}
+	return false
+}
+
+// the union with other
+func (regs *hllRegisters) merge(other *hllRegisters) {
+	for i, r := range other {
+		if r > regs[i] {
+			regs[i] = r
+		}
+	}
+}
+
+// the estimated cardinality, by the estimator of Otmar Ertl, like redis
+func (regs *hllRegisters) count() uint64 {
+	var histo [64]int
+	for _, r := range regs {
+		histo[r]++
+	}
+	m := float64(kHllRegisters)
+	z := m * hllTau((m-float64(histo[kHllQ+1]))/m)
+	for j := kHllQ; j >= 1; j-- {
+		z += float64(histo[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histo[0])/m)
+	return uint64(math.Round(0.5 / math.Ln2 * m * m / z))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if prev == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if prev == z {
+			return z / 3
+		}
+	}
+}
+
+// MurmurHash64A, as redis hashes the elements
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m, r = 0xc6a4a7935bd1e995, 47
+	h := seed ^ uint64(len(key))*m
+	for ; len(key) >= 8; key = key[8:] {
+		k := binary.LittleEndian.Uint64(key)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+	if len(key) > 0 {
+		for i := len(key) - 1; i >= 0; i-- {
+			h ^= uint64(key[i]) << (8 * uint(i))
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
@@ -11,19 +11,24 @@ var (
 
 const (
 	SeqStart = 1073741824
+
+	kListMetaSize = 16
 )
 
+// meta: header, count, min-seq, add-ts, update-ts. Each element is saved as its own key,
+// unless the list is small: then the elements follow the meta, each as uvarint length + bytes
 type LinkedList []byte
 
 func NewLinkedList(a *Arena, key []byte, values [][]byte) (ks, vs [][]byte) {
 	now := uint32(time.Now().Unix())
 	ks, vs = createKvs(len(values) + 1)
 
-	listMeta := a.Allocate(16)
-	bigEndian.PutUint32(listMeta, uint32(len(values)))  // count
-	bigEndian.PutUint32(listMeta[4:], uint32(SeqStart)) // min-seq
-	bigEndian.PutUint32(listMeta[8:], now)              // add-ts
-	bigEndian.PutUint32(listMeta[12:], now)             // update-ts
+	listMeta := newMeta(a, kTypeList, 16)
+	m := listMeta[kMetaHeaderSize:]
+	bigEndian.PutUint32(m, uint32(len(values)))  // count
+	bigEndian.PutUint32(m[4:], uint32(SeqStart)) // min-seq
+	bigEndian.PutUint32(m[8:], now)              // add-ts
+	bigEndian.PutUint32(m[12:], now)             // update-ts
 	ks[0] = key
 	vs[0] = listMeta
 
@@ -35,12 +40,87 @@ func NewLinkedList(a *Arena, key []byte, values [][]byte) (ks, vs [][]byte) {
 	return
 }
 
+// the meta of a list saved inline, old is the meta it replaces, nil for a new list
+func NewInlineList(a *Arena, old LinkedList, values [][]byte) LinkedList {
+	size := kListMetaSize
+	for _, v := range values {
+		size += uvarintSize(len(v)) + len(v)
+	}
+	now := uint32(time.Now().Unix())
+	li := LinkedList(newMeta(a, kTypeList, size))
+	m := li[kMetaHeaderSize:]
+	if old != nil {
+		copy(li, old[:kMetaHeaderSize+kListMetaSize]) // expire-at and add-ts
+	} else {
+		bigEndian.PutUint32(m[8:], now) // add-ts
+	}
+	bigEndian.PutUint32(m, uint32(len(values)))  // count
+	bigEndian.PutUint32(m[4:], uint32(SeqStart)) // min-seq
+	bigEndian.PutUint32(m[12:], now)             // update-ts
+
+	off := kMetaHeaderSize + kListMetaSize
+	for _, v := range values {
+		off += binary.PutUvarint(li[off:], uint64(len(v)))
+		off += copy(li[off:], v)
+	}
+	return li
+}
+
+func uvarintSize(n int) int {
+	size := 1
+	for ; n >= 0x80; n >>= 7 {
+		size += 1
+	}
+	return size
+}
+
+// no data keys, the elements are saved in the meta
+func (li LinkedList) inline() bool {
+	return len(li) > kMetaHeaderSize+kListMetaSize
+}
+
+func (li LinkedList) inlineValues() [][]byte {
+	llen, _ := li.listMeta()
+	values := make([][]byte, 0, llen)
+	for b := li[kMetaHeaderSize+kListMetaSize:]; len(b) > 0; {
+		n, size := binary.Uvarint(b)
+		values = append(values, b[size:size+int(n):size+int(n)])
+		b = b[size+int(n):]
+	}
+	return values
+}
+
 func createKvs(size int) (ks, vs [][]byte) {
 	kvs := make([][]byte, size*2) // allocate memory just once
 	ks, vs = kvs[:size], kvs[size:]
 	return
 }
 
+// prefix + len(key) + key + member: the length keeps ("a", "bc") and ("ab", "c") apart,
+// and all members of a key stay together, so they can be read by a single prefix scan
+func memberKey(a *Arena, prefix byte, mKey, member []byte) []byte {
+	key := mKey[1:] // ignore the first meta key prefix
+	k := a.Allocate(len(key) + len(member) + 4 + 1)
+	k[0] = prefix
+	bigEndian.PutUint32(k[1:], uint32(len(key)))
+	copy(k[5:], key)
+	copy(k[5+len(key):], member)
+	return k
+}
+
+// the smallest key greater than every key starting with prefix, nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i] += 1
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
 func listDataKey(a *Arena, mKey []byte, seq int) []byte {
 	dKey := a.Allocate(len(mKey) + 4 + 1)
 	dKey[0] = kListDataKeyPrefix
@@ -55,8 +135,9 @@ func (li LinkedList) Rpush(a *Arena, key []byte, values [][]byte) (ks, vs [][]by
 	ks, vs = createKvs(len(values) + 1)
 
 	size, minseq := li.listMeta()
-	bigEndian.PutUint32(li, uint32(len(values)+size)) // count
-	bigEndian.PutUint32(li[12:], now)                 // update-ts
+	m := li[kMetaHeaderSize:]
+	bigEndian.PutUint32(m, uint32(len(values)+size)) // count
+	bigEndian.PutUint32(m[12:], now)                 // update-ts
 	ks[0] = key
 	vs[0] = []byte(li)
 
@@ -73,9 +154,10 @@ func (li LinkedList) Lpush(a *Arena, key []byte, values [][]byte) (ks, vs [][]by
 	ks, vs = createKvs(len(values) + 1)
 
 	size, minseq := li.listMeta()
-	bigEndian.PutUint32(li, uint32(len(values)+size))       // count
-	bigEndian.PutUint32(li[4:], uint32(minseq-len(values))) // min-seq
-	bigEndian.PutUint32(li[12:], now)                       // update-ts
+	m := li[kMetaHeaderSize:]
+	bigEndian.PutUint32(m, uint32(len(values)+size))       // count
+	bigEndian.PutUint32(m[4:], uint32(minseq-len(values))) // min-seq
+	bigEndian.PutUint32(m[12:], now)                       // update-ts
 	ks[0] = key
 	vs[0] = []byte(li)
 
@@ -89,7 +171,7 @@ func (li LinkedList) Lpush(a *Arena, key []byte, values [][]byte) (ks, vs [][]by
 
 func (li LinkedList) Pop(a *Arena, mKey []byte, left, right int) (ks, vs [][]byte) {
 	llen, minseq := li.listMeta()
-	if left+right > llen {
+	if left+right >= llen { // nothing left, the list is gone
 		ks, vs = createKvs(llen + 1)
 		ks[0] = mKey
 		for i := 0; i < llen; i++ {
@@ -98,9 +180,10 @@ func (li LinkedList) Pop(a *Arena, mKey []byte, left, right int) (ks, vs [][]byt
 	} else {
 		ks, vs = createKvs(left + right + 1)
 		now := uint32(time.Now().Unix())
-		bigEndian.PutUint32(li, uint32(llen-left-right)) // count
-		bigEndian.PutUint32(li[4:], uint32(minseq-left)) // min-seq
-		bigEndian.PutUint32(li[12:], now)                // update-ts
+		m := li[kMetaHeaderSize:]
+		bigEndian.PutUint32(m, uint32(llen-left-right)) // count
+		bigEndian.PutUint32(m[4:], uint32(minseq+left)) // min-seq
+		bigEndian.PutUint32(m[12:], now)                // update-ts
 		ks[0] = mKey
 		vs[0] = []byte(li)
 
@@ -115,6 +198,15 @@ func (li LinkedList) Pop(a *Arena, mKey []byte, left, right int) (ks, vs [][]byt
 	return
 }
 
+// after elements are inserted or removed in the middle
+func (li LinkedList) setListMeta(size, minseq int) {
+	m := li[kMetaHeaderSize:]
+	bigEndian.PutUint32(m, uint32(size))                   // count
+	bigEndian.PutUint32(m[4:], uint32(minseq))             // min-seq
+	bigEndian.PutUint32(m[12:], uint32(time.Now().Unix())) // update-ts
+}
+
 func (li LinkedList) listMeta() (size, seqstart int) {
-	return int(bigEndian.Uint32(li)), int(bigEndian.Uint32(li[4:]))
+	m := li[kMetaHeaderSize:]
+	return int(bigEndian.Uint32(m)), int(bigEndian.Uint32(m[4:]))
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"time"
+)
+
+// meta: header, count, add-ts, update-ts. Each member is saved as its own key,
+// with an empty value
+type Set []byte
+
+func NewSet(a *Arena) Set {
+	now := uint32(time.Now().Unix())
+	setMeta := newMeta(a, kTypeSet, 12)
+	m := setMeta[kMetaHeaderSize:]
+	bigEndian.PutUint32(m, 0)       // count
+	bigEndian.PutUint32(m[4:], now) // add-ts
+	bigEndian.PutUint32(m[8:], now) // update-ts
+	return Set(setMeta)
+}
+
+func setMemberKey(a *Arena, mKey, member []byte) []byte {
+	return memberKey(a, kSetMemberKeyPrefix, mKey, member)
+}
+
+func (s Set) size() int {
+	return int(bigEndian.Uint32(s[kMetaHeaderSize:]))
+}
+
+func (s Set) setSize(size int) {
+	m := s[kMetaHeaderSize:]
+	bigEndian.PutUint32(m, uint32(size))                  // count
+	bigEndian.PutUint32(m[8:], uint32(time.Now().Unix())) // update-ts
+}
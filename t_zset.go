@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// meta: header, count, add-ts, update-ts. Each member is saved twice: member => score,
+// for ZSCORE, and an empty score + member key, which keeps members ordered by score
+type SortedSet []byte
+
+func NewSortedSet(a *Arena) SortedSet {
+	now := uint32(time.Now().Unix())
+	zsetMeta := newMeta(a, kTypeZset, 12)
+	m := zsetMeta[kMetaHeaderSize:]
+	bigEndian.PutUint32(m, 0)       // count
+	bigEndian.PutUint32(m[4:], now) // add-ts
+	bigEndian.PutUint32(m[8:], now) // update-ts
+	return SortedSet(zsetMeta)
+}
+
+func (z SortedSet) size() int {
+	return int(bigEndian.Uint32(z[kMetaHeaderSize:]))
+}
+
+func (z SortedSet) setSize(size int) {
+	m := z[kMetaHeaderSize:]
+	bigEndian.PutUint32(m, uint32(size))                  // count
+	bigEndian.PutUint32(m[8:], uint32(time.Now().Unix())) // update-ts
+}
+
+// IEEE 754 bits compare like sign-magnitude integers: flip the sign bit of
+// positives and all bits of negatives, then big endian bytes sort like the doubles
+func encodeScore(b []byte, score float64) {
+	if score == 0 {
+		score = 0 // -0 and 0 are the same score
+	}
+	bits := math.Float64bits(score)
+	if bits&(1<<63) == 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	bigEndian.PutUint64(b, bits)
+}
+
+func decodeScore(b []byte) float64 {
+	bits := bigEndian.Uint64(b)
+	if bits&(1<<63) != 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
+
+func formatScore(score float64) []byte {
+	switch {
+	case math.IsInf(score, 1):
+		return []byte("inf")
+	case math.IsInf(score, -1):
+		return []byte("-inf")
+	}
+	return []byte(strconv.FormatFloat(score, 'g', -1, 64))
+}
+
+func parseScore(b []byte) (float64, error) {
+	score, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, ErrExpectFloat
+	}
+	return score, nil
+}
+
+func zsetMemberKey(a *Arena, mKey, member []byte) []byte {
+	return memberKey(a, kZsetMemberKeyPrefix, mKey, member)
+}
+
+// i + len(key) + key + score + member
+func zsetScoreKey(a *Arena, mKey []byte, score float64, member []byte) []byte {
+	sm := a.Allocate(8 + len(member))
+	encodeScore(sm, score)
+	copy(sm[8:], member)
+	return memberKey(a, kZsetScoreKeyPrefix, mKey, sm)
+}
+
+func zsetScorePrefix(a *Arena, mKey []byte) []byte {
+	return memberKey(a, kZsetScoreKeyPrefix, mKey, nil)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestEncodeScore(t *testing.T) {
+	scores := []float64{math.Inf(-1), -1e300, -2.5, -1, -math.SmallestNonzeroFloat64,
+		0, math.SmallestNonzeroFloat64, 0.5, 1, 3.14, 1e300, math.Inf(1)}
+
+	prev := make([]byte, 8)
+	for i, score := range scores {
+		b := make([]byte, 8)
+		encodeScore(b, score)
+		if decodeScore(b) != score {
+			t.Errorf("decode %v, get %v", score, decodeScore(b))
+		}
+		if i > 0 && bytes.Compare(prev, b) >= 0 {
+			t.Errorf("%v should sort before %v", scores[i-1], score)
+		}
+		prev = b
+	}
+
+	a, b := make([]byte, 8), make([]byte, 8)
+	encodeScore(a, math.Copysign(0, -1))
+	encodeScore(b, 0)
+	if !bytes.Equal(a, b) {
+		t.Error("-0 and 0 should encode the same")
+	}
+}
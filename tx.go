@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// commands queued between MULTI and EXEC
+type transaction struct {
+	reqs  []*Request
+	dirty bool // a command could not be queued, EXEC discards them all
+}
+
+// not queued, run right away inside MULTI
+var txCommands = map[string]bool{"MULTI": true, "EXEC": true, "DISCARD": true, "WATCH": true}
+
+// commands whose arguments are all keys, or key value pairs, or all but the
+// first, or which store to the key after a STORE option. The others are
+// locked by their first argument, if they have one
+var (
+	allKeysCommands = map[string]bool{"DEL": true, "EXISTS": true, "UNLINK": true, "MGET": true,
+		"SINTER": true, "SUNION": true, "SDIFF": true, "SINTERSTORE": true, "SUNIONSTORE": true, "SDIFFSTORE": true,
+		"BLPOP": true, "BRPOP": true, "PFCOUNT": true, "PFMERGE": true}
+	pairsCommands    = map[string]bool{"MSET": true, "MSETNX": true}
+	twoKeysCommands  = map[string]bool{"RPOPLPUSH": true, "LMOVE": true, "BRPOPLPUSH": true, "GEOSEARCHSTORE": true}
+	tailKeysCommands = map[string]bool{"BITOP": true}
+	storeKeyCommands = map[string]bool{"GEORADIUS": true, "GEORADIUSBYMEMBER": true}
+)
+
+// the request is reused by the next read, queue a copy
+func (tx *transaction) queue(req *Request) {
+	args := make([][]byte, req.Size)
+	for i := 0; i < req.Size; i++ {
+		args[i] = append([]byte{}, req.Arguments[i]...)
+	}
+	tx.reqs = append(tx.reqs, &Request{Command: req.Command, Size: req.Size, Arguments: args})
+}
+
+// all keys the queued commands may touch
+func (tx *transaction) keys() [][]byte {
+	var keys [][]byte
+	for _, req := range tx.reqs {
+		args := req.Arguments[:req.Size]
+		switch {
+		case allKeysCommands[req.Command]:
+			keys = append(keys, args...)
+		case pairsCommands[req.Command]:
+			for i := 0; i < len(args); i += 2 {
+				keys = append(keys, args[i])
+			}
+		case twoKeysCommands[req.Command] && len(args) >= 2:
+			keys = append(keys, args[0], args[1])
+		case tailKeysCommands[req.Command] && len(args) >= 2:
+			keys = append(keys, args[1:]...)
+		case storeKeyCommands[req.Command] && len(args) > 0:
+			keys = append(keys, args[0])
+			for i := 1; i+1 < len(args); i++ {
+				if opt := strings.ToUpper(string(args[i])); opt == "STORE" || opt == "STOREDIST" {
+					keys = append(keys, args[i+1])
+				}
+			}
+		case len(args) > 0:
+			keys = append(keys, args[0])
+		}
+	}
+	return keys
+}
+
+func (h *DbHandler) Multi(c *redisClient) error {
+	if c.multi != nil {
+		return ErrNestedMulti
+	}
+	c.multi = &transaction{}
+	return nil
+}
+
+func (h *DbHandler) Discard(c *redisClient) error {
+	if c.multi == nil {
+		return ErrDiscardWithoutMulti
+	}
+	c.multi = nil
+	return h.Unwatch(c)
+}
+
+// Run the queued commands with the locks of all their keys held, unless a
+// watched key is written. Their writes are buffered, and saved in one batch
+// for each db at the end.
+func (h *DbHandler) Exec(c *redisClient) (Reply, error) {
+	tx := c.multi
+	if tx == nil {
+		return nil, ErrExecWithoutMulti
+	}
+	c.multi = nil
+	defer h.Unwatch(c)
+	if tx.dirty {
+		return nil, ErrExecAbort
+	}
+	keys := tx.keys()
+	for _, wt := range c.watched {
+		keys = append(keys, []byte(wt.key))
+	}
+	defer locks.lock(c, keys...)()
+	if c.watchedChanged() {
+		return ArrayReply{}, nil // a null array
+	}
+
+	c.writes = make(map[Store]*txStore)
+	defer func() {
+		c.writes = nil
+		c.db = h.server.db(c.dbIdx)
+	}()
+	replies := make([]Reply, len(tx.reqs))
+	for i, req := range tx.reqs {
+		c.db = c.useDb(h.server.db(c.dbIdx)) // SELECT may change it
+		r, err := h.server.Handle(c, req)
+		if err != nil {
+			r = ErrorReply{err.Error()}
+		}
+		replies[i] = r
+	}
+	for _, t := range c.writes {
+		if err := t.commit(); err != nil {
+			return nil, err
+		}
+	}
+	return ArrayReply{replies}, nil
+}
+
+// db, or the buffered writes to it in EXEC
+func (c *redisClient) useDb(db Store) Store {
+	if c.writes == nil {
+		return db
+	}
+	if c.writes[db] == nil {
+		c.writes[db] = &txStore{db: db, writes: make(map[string][]byte)}
+	}
+	return c.writes[db]
+}
+
+// the db under the buffered writes of EXEC, and the compact keys a command reads
+func baseStore(db Store) Store {
+	switch s := db.(type) {
+	case *txStore:
+		return s.db
+	case *compactStore:
+		return baseStore(s.db)
+	}
+	return db
+}
+
+// Writes of EXEC, kept in memory until commit. Reads see them on top of db.
+type txStore struct {
+	db     Store
+	writes map[string][]byte // nil value for deleted
+}
+
+func (t *txStore) Get(a *Arena, key []byte) ([]byte, error) {
+	if v, ok := t.writes[string(key)]; ok {
+		if v == nil {
+			return nil, nil
+		}
+		r := a.Allocate(len(v)) // callers may change it in place
+		copy(r, v)
+		return r, nil
+	}
+	return t.db.Get(a, key)
+}
+
+func (t *txStore) Set(key, value []byte) error {
+	t.writes[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (t *txStore) Delete(key []byte) error {
+	t.writes[string(key)] = nil
+	return nil
+}
+
+func (t *txStore) Batch(ks, vs [][]byte) error {
+	for i, k := range ks {
+		if vs[i] == nil {
+			t.Delete(k)
+		} else {
+			t.Set(k, vs[i])
+		}
+	}
+	return nil
+}
+
+func (t *txStore) Scan(a *Arena, start []byte, collector func(key, val []byte) bool) error {
+	return t.ScanRange(a, start, nil, false, collector)
+}
+
+// the keys of db in range, with the buffered writes merged in
+func (t *txStore) ScanRange(a *Arena, start, limit []byte, reverse bool, collector func(key, val []byte) bool) error {
+	keys := make([]string, 0)
+	for k := range t.writes {
+		if k >= string(start) && (limit == nil || k < string(limit)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if reverse {
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+
+	i, stopped := 0, false
+	emit := func(k string) bool { // the buffered write of k, if it's not a delete
+		if v := t.writes[k]; v != nil && !collector([]byte(k), append([]byte{}, v...)) {
+			stopped = true
+		}
+		return !stopped
+	}
+	err := t.db.ScanRange(a, start, limit, reverse, func(k, v []byte) bool {
+		for ; i < len(keys); i++ {
+			if c := bytes.Compare([]byte(keys[i]), k); c == 0 {
+				i++
+				return emit(keys[i-1])
+			} else if (c > 0) != reverse { // comes after k in scan order
+				break
+			}
+			if !emit(keys[i]) {
+				return false
+			}
+		}
+		if !collector(k, v) {
+			stopped = true
+		}
+		return !stopped
+	})
+	for ; err == nil && !stopped && i < len(keys); i++ {
+		emit(keys[i])
+	}
+	return err
+}
+
+func (t *txStore) commit() error {
+	ks, vs := make([][]byte, 0, len(t.writes)), make([][]byte, 0, len(t.writes))
+	for k, v := range t.writes {
+		ks, vs = append(ks, []byte(k)), append(vs, v)
+	}
+	if len(ks) == 0 {
+		return nil
+	}
+	return t.db.Batch(ks, vs)
+}
+
+func (t *txStore) Close() error { return nil }
+
+func (t *txStore) Flush() error { return t.db.Flush() }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMultiExec(t *testing.T) {
+	s, done := newTestServer(t, 2)
+	defer done()
+
+	c := NewReisClient(&MockConn{})
+	run := func(args ...string) Reply {
+		c.db = s.db(c.dbIdx)
+		r, err := s.Handle(c, newRequest(args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	run("MULTI")
+	for _, cmd := range [][]string{{"SET", "a", "1"}, {"INCR", "a"}, {"LPUSH", "a", "x"},
+		{"HSET", "h", "f", "v"}, {"HGETALL", "h"}, {"GET", "a"}} {
+		if r := run(cmd...); r != (StatusReply{"QUEUED"}) {
+			t.Errorf("expect QUEUED, get %v", r)
+		}
+	}
+	if r := run("GET", "a"); r != (StatusReply{"QUEUED"}) {
+		t.Errorf("expect GET queued, get %v", r)
+	}
+	c.bw.buffer.pos = 0
+	run("EXEC").Write(c.bw)
+	expect := "*7\r\n+OK\r\n:2\r\n-WRONGTYPE Operation against a key holding the wrong kind of value\r\n" +
+		":1\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n$1\r\n2\r\n$1\r\n2\r\n"
+	if got := string(c.bw.buffer.buffer[:c.bw.buffer.pos]); got != expect {
+		t.Errorf("expect %q, get %q", expect, got)
+	}
+	if r := run("HGET", "h", "f"); string(r.(BulkReply).value) != "v" {
+		t.Errorf("expect v, get %v", r)
+	}
+
+	// SELECT in a transaction
+	run("MULTI")
+	run("SELECT", "1")
+	run("RPUSH", "l", "a", "b")
+	run("MOVE", "l", "0")
+	run("EXEC")
+	if c.dbIdx != 1 {
+		t.Errorf("expect db 1 selected, get %v", c.dbIdx)
+	}
+	c.dbIdx = 0
+	if r := run("LRANGE", "l", "0", "-1"); len(r.(MultiBulkReply).values) != 2 {
+		t.Errorf("expect list moved to db 0, get %v", r)
+	}
+
+	run("MULTI")
+	run("SET", "a", "100")
+	if r := run("NOSUCHCOMMAND"); r != ErrMethodNotSupported {
+		t.Errorf("expect not supported, get %v", r)
+	}
+	if r := run("EXEC"); r != ErrExecAbort {
+		t.Errorf("expect EXECABORT, get %v", r)
+	}
+	run("MULTI")
+	run("SET", "a", "100")
+	if r := run("MULTI"); r != ErrNestedMulti {
+		t.Errorf("expect nested error, get %v", r)
+	}
+	run("DISCARD")
+	if r := run("GET", "a"); string(r.(BulkReply).value) != "2" {
+		t.Errorf("expect 2, get %v", r)
+	}
+	if r := run("EXEC"); r != ErrExecWithoutMulti {
+		t.Errorf("expect EXEC without MULTI, get %v", r)
+	}
+}
+
+func TestTxStoreScan(t *testing.T) {
+	_, c, done := newTestClient(t)
+	defer done()
+
+	for _, k := range []string{"b", "d", "f"} {
+		c.db.Set([]byte(k), []byte("db"))
+	}
+	tx := &txStore{db: c.db, writes: make(map[string][]byte)}
+	tx.Set([]byte("a"), []byte("tx"))
+	tx.Set([]byte("d"), []byte("tx"))
+	tx.Delete([]byte("f"))
+	tx.Set([]byte("g"), []byte("tx"))
+
+	scan := func(start, limit string, reverse bool, n int) string {
+		var l []byte
+		if limit != "" {
+			l = []byte(limit)
+		}
+		got := ""
+		tx.ScanRange(c.arena, []byte(start), l, reverse, func(k, v []byte) bool {
+			got += fmt.Sprintf("%s=%s ", k, v)
+			n -= 1
+			return n > 0
+		})
+		return got
+	}
+	cases := []struct {
+		got, expect string
+	}{
+		{scan("", "", false, 10), "a=tx b=db d=tx g=tx "},
+		{scan("", "", true, 10), "g=tx d=tx b=db a=tx "},
+		{scan("b", "g", false, 10), "b=db d=tx "},
+		{scan("a", "z", true, 2), "g=tx d=tx "},
+		{scan("", "", false, 1), "a=tx "},
+	}
+	for _, c := range cases {
+		if c.got != c.expect {
+			t.Errorf("expect %q, get %q", c.expect, c.got)
+		}
+	}
+	if v, _ := tx.Get(c.arena, []byte("f")); v != nil {
+		t.Errorf("expect f deleted, get %s", v)
+	}
+
+	tx.commit()
+	if v, _ := c.db.Get(c.arena, []byte("d")); string(v) != "tx" {
+		t.Errorf("expect d committed, get %s", v)
+	}
+	if v, _ := c.db.Get(c.arena, []byte("f")); v != nil {
+		t.Errorf("expect f deleted, get %s", v)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s, done := newTestServer(t, 1)
+	defer done()
+
+	c1, c2 := NewReisClient(&MockConn{}), NewReisClient(&MockConn{})
+	run := func(c *redisClient, args ...string) Reply {
+		c.db = s.db(c.dbIdx)
+		r, err := s.Handle(c, newRequest(args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	aborted := func(r Reply) bool {
+		return r.(ArrayReply).replies == nil
+	}
+
+	run(c1, "HSET", "h", "f", "1")
+	for _, write := range [][]string{{"SET", "k", "v"}, {"HSET", "h", "f", "2"}, {"HINCRBY", "h", "f", "1"},
+		{"EXPIRE", "h", "100"}, {"DEL", "h"}} {
+		key := write[1]
+		run(c1, "WATCH", key)
+		run(c2, write...)
+		run(c1, "MULTI")
+		run(c1, "SET", "out", write[0])
+		if r := run(c1, "EXEC"); !aborted(r) {
+			t.Errorf("%v: expect aborted, get %v", write, r)
+		}
+	}
+	if r := run(c1, "GET", "out"); r.(BulkReply).value != nil {
+		t.Errorf("expect nothing written, get %v", r)
+	}
+
+	// keys nobody else writes
+	run(c1, "WATCH", "k", "other")
+	run(c2, "SET", "another", "v")
+	run(c1, "MULTI")
+	run(c1, "SET", "out", "1")
+	if r := run(c1, "EXEC"); aborted(r) {
+		t.Error("expect executed")
+	}
+
+	run(c1, "WATCH", "k")
+	run(c1, "UNWATCH")
+	run(c2, "SET", "k", "v2")
+	run(c1, "MULTI")
+	if r := run(c1, "WATCH", "k"); r != ErrWatchInMulti {
+		t.Errorf("expect WATCH in MULTI error, get %v", r)
+	}
+	if r := run(c1, "EXEC"); aborted(r) {
+		t.Error("expect executed after UNWATCH")
+	}
+	if n := len(s.db(0).(*watchStore).versions); n != 0 {
+		t.Errorf("expect nothing watched, get %v", n)
+	}
+}
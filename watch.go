@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Counts writes to the keys clients WATCH. Other keys are not tracked.
+type watchStore struct {
+	Store
+	sync.Mutex
+	versions map[string]*watchedKey
+	watched  int32 // len(versions), read without the lock by every write
+}
+
+type watchedKey struct {
+	version  uint64
+	watchers int
+}
+
+// a key a client watches, and its version then
+type watch struct {
+	db      *watchStore
+	key     string
+	version uint64
+}
+
+func newWatchStore(db Store) *watchStore {
+	return &watchStore{Store: db, versions: make(map[string]*watchedKey)}
+}
+
+// the key of the meta or data key k, nil for keys of no key
+func logicalKey(k []byte) []byte {
+	if len(k) == 0 {
+		return nil
+	}
+	switch k[0] {
+	case kMetaKeyPrefix:
+		return k[1:]
+	case kListDataKeyPrefix: // d + key + ':' + seq
+		if len(k) >= 6 {
+			return k[1 : len(k)-5]
+		}
+	case kHashFieldKeyPrefix, kSetMemberKeyPrefix, kZsetMemberKeyPrefix, kZsetScoreKeyPrefix, kBitmapPageKeyPrefix:
+		if len(k) >= 5 {
+			if n := int(bigEndian.Uint32(k[1:])); len(k) >= 5+n {
+				return k[5 : 5+n]
+			}
+		}
+	}
+	return nil
+}
+
+func (w *watchStore) watch(key []byte) watch {
+	w.Lock()
+	defer w.Unlock()
+	wk := w.versions[string(key)]
+	if wk == nil {
+		wk = &watchedKey{}
+		w.versions[string(key)] = wk
+		atomic.StoreInt32(&w.watched, int32(len(w.versions)))
+	}
+	wk.watchers += 1
+	return watch{db: w, key: string(key), version: wk.version}
+}
+
+// whether the key is written since watched
+func (w *watchStore) changed(wt watch) bool {
+	w.Lock()
+	defer w.Unlock()
+	return w.versions[wt.key].version != wt.version
+}
+
+func (w *watchStore) unwatch(wt watch) {
+	w.Lock()
+	defer w.Unlock()
+	wk := w.versions[wt.key]
+	if wk.watchers -= 1; wk.watchers == 0 {
+		delete(w.versions, wt.key)
+		atomic.StoreInt32(&w.watched, int32(len(w.versions)))
+	}
+}
+
+// Called after the write: a client that reads the key after WATCH and before
+// the write is done sees the version change
+func (w *watchStore) touch(keys ...[]byte) {
+	if atomic.LoadInt32(&w.watched) == 0 {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	for _, k := range keys {
+		if key := logicalKey(k); key != nil {
+			if wk := w.versions[string(key)]; wk != nil {
+				wk.version += 1
+			}
+		}
+	}
+}
+
+func (w *watchStore) Set(key, value []byte) error {
+	defer w.touch(key)
+	return w.Store.Set(key, value)
+}
+
+func (w *watchStore) Batch(ks, vs [][]byte) error {
+	defer w.touch(ks...)
+	return w.Store.Batch(ks, vs)
+}
+
+func (w *watchStore) Delete(key []byte) error {
+	defer w.touch(key)
+	return w.Store.Delete(key)
+}
+
+// WATCH key [key ...], EXEC does nothing if any of them is written before it
+func (h *DbHandler) Watch(c *redisClient, keys ...[]byte) error {
+	if c.multi != nil {
+		return ErrWatchInMulti
+	}
+	db, ok := baseStore(c.db).(*watchStore)
+	if !ok {
+		return ErrMethodNotSupported
+	}
+	for _, key := range keys {
+		c.watched = append(c.watched, db.watch(key))
+	}
+	return nil
+}
+
+func (h *DbHandler) Unwatch(c *redisClient) error {
+	c.unwatchAll()
+	return nil
+}
+
+func (c *redisClient) unwatchAll() {
+	for _, wt := range c.watched {
+		wt.db.unwatch(wt)
+	}
+	c.watched = nil
+}
+
+// whether any watched key is written since WATCH
+func (c *redisClient) watchedChanged() bool {
+	for _, wt := range c.watched {
+		if wt.db.changed(wt) {
+			return true
+		}
+	}
+	return false
+}